@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+var avatarHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// Get the storage key of a profile picture.
+func avatarKey(jid types.JID, pictureID string) string {
+	return fmt.Sprintf("avatars/%s-%s.jpg", jid.String(), pictureID)
+}
+
+// Delete the file of a cached profile picture.
+func deleteAvatarFile(key string) {
+	if err := mediaStore.Delete(context.Background(), key); err != nil && !errors.Is(err, ErrMediaNotFound) {
+		log.Errorf("Error deleting profile picture %s: %v", key, err)
+	}
+}
+
+// Fetch the profile picture of a user or group and cache it in the media store, where it is
+// encrypted like media files. If the picture hasn't changed since it was last cached, the
+// cached entry is returned as-is.
+func fetchAvatar(jid types.JID) (*Avatar, error) {
+	jid = jid.ToNonAD()
+	cached, err := getAvatar(jid.String())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	params := &whatsmeow.GetProfilePictureParams{}
+	if cached != nil {
+		if _, err := mediaStore.Stat(context.Background(), cached.StorageKey); err == nil {
+			params.ExistingID = cached.PictureID
+		}
+	}
+
+	info, err := cli.GetProfilePictureInfo(jid, params)
+	if errors.Is(err, whatsmeow.ErrProfilePictureNotSet) || errors.Is(err, whatsmeow.ErrProfilePictureUnauthorized) {
+		removeAvatar(jid)
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get profile picture info: %w", err)
+	} else if info == nil {
+		return cached, nil
+	}
+
+	resp, err := avatarHTTPClient.Get(info.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download profile picture: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download profile picture: unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download profile picture: %w", err)
+	}
+
+	key := avatarKey(jid, info.ID)
+	if err := saveMedia(key, data, "image/jpeg"); err != nil {
+		return nil, fmt.Errorf("failed to save profile picture: %w", err)
+	}
+	if cached != nil && cached.StorageKey != key {
+		deleteAvatarFile(cached.StorageKey)
+	}
+
+	avatar := Avatar{JID: jid.String(), PictureID: info.ID, StorageKey: key, UpdatedAt: time.Now()}
+	if err := upsertAvatar(avatar); err != nil {
+		return nil, err
+	}
+	log.Infof("Cached profile picture of %s to %s", jid, key)
+	return &avatar, nil
+}
+
+// Delete the cached profile picture of a user or group.
+func removeAvatar(jid types.JID) {
+	cached, err := getAvatar(jid.String())
+	if err != nil {
+		return
+	}
+	deleteAvatarFile(cached.StorageKey)
+	if err := deleteAvatar(jid.String()); err != nil {
+		log.Errorf("Error deleting avatar: %v", err)
+	}
+	log.Infof("Removed cached profile picture of %s", jid)
+}
+
+func handleGetAvatar(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: getavatar <jid>")
+		sendReply("getavatar", nil, fmt.Errorf("usage: getavatar <jid>"))
+		return
+	}
+
+	jid, err := parseJID(args[0])
+	if err != nil {
+		sendReply("getavatar", nil, err)
+		return
+	}
+
+	avatar, err := fetchAvatar(jid)
+	if err != nil {
+		log.Errorf("Failed to fetch profile picture of %s: %v", jid, err)
+		sendReply("getavatar", nil, err)
+		return
+	}
+	sendReply("getavatar", avatar, nil)
+}
+
+// Refresh cached profile pictures when they change. Pictures that were never requested are not fetched.
+func handlePicture(evt *events.Picture) {
+	jid := evt.JID.ToNonAD()
+	if evt.Remove {
+		removeAvatar(jid)
+		return
+	}
+	if _, err := getAvatar(jid.String()); err != nil {
+		return
+	}
+	go func() {
+		if _, err := fetchAvatar(jid); err != nil {
+			log.Errorf("Failed to refresh profile picture of %s: %v", jid, err)
+		}
+	}()
+}
+
+// ServeAvatar serves the cached profile picture of a JID on /avatar/{jid}, using the picture ID as the ETag.
+func serveAvatar(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-None-Match")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	jid, err := parseJID(strings.TrimPrefix(r.URL.Path, "/avatar/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	avatar, err := getAvatar(jid.ToNonAD().String())
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Avatar not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to get avatar", err)
+		return
+	}
+
+	file, _, err := mediaStore.Open(context.Background(), avatar.StorageKey)
+	if errors.Is(err, ErrMediaNotFound) {
+		http.Error(w, "Avatar not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to open avatar", err)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", fmt.Sprintf("%q", avatar.PictureID))
+	http.ServeContent(w, r, "", avatar.UpdatedAt, file)
+}
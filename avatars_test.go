@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestAvatarFiles(t *testing.T) {
+	store, err := newLocalMediaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStore := mediaStore
+	defer func() { mediaStore = oldStore }()
+	mediaStore = store
+
+	jid := types.NewJID("905321234567", types.DefaultUserServer)
+	key := avatarKey(jid, "123")
+	if want := "avatars/905321234567@s.whatsapp.net-123.jpg"; key != want {
+		t.Errorf("avatarKey() = %q, want %q", key, want)
+	}
+
+	if err := saveMedia(key, []byte("picture"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readAll(store, key); err != nil || string(data) != "picture" {
+		t.Errorf("read %q, %v, want the stored picture", data, err)
+	}
+
+	deleteAvatarFile(key)
+	if _, err := store.Stat(context.Background(), key); !errors.Is(err, ErrMediaNotFound) {
+		t.Errorf("avatar %s wasn't deleted: %v", key, err)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// The blocklist is cached, so that sending to blocked JIDs can be refused without asking the
+// server. It is refreshed on every connect and kept up to date with blocklist notifications.
+// The privacy setting query below is sent directly, as whatsmeow has no privacy setter.
+
+var (
+	blocklist   = make(map[types.JID]struct{})
+	blocklistMu sync.RWMutex
+)
+
+// Check if sending to a JID is refused because it is on the blocklist.
+func isBlocked(jid types.JID) bool {
+	blocklistMu.RLock()
+	defer blocklistMu.RUnlock()
+	_, ok := blocklist[jid.ToNonAD()]
+	return ok
+}
+
+// Replace the cached blocklist with a blocklist from the server.
+func storeBlocklist(list *types.Blocklist) []types.JID {
+	jids := make([]types.JID, 0, len(list.JIDs))
+	for _, jid := range list.JIDs {
+		jids = append(jids, jid.ToNonAD())
+	}
+
+	blocklistMu.Lock()
+	blocklist = make(map[types.JID]struct{}, len(jids))
+	for _, jid := range jids {
+		blocklist[jid] = struct{}{}
+	}
+	blocklistMu.Unlock()
+	return jids
+}
+
+// Fetch the blocklist from the server and refresh the cached copy.
+func fetchBlocklist() ([]types.JID, error) {
+	list, err := cli.GetBlocklist()
+	if err != nil {
+		return nil, err
+	}
+	return storeBlocklist(list), nil
+}
+
+// Block or unblock a JID and return the updated blocklist.
+func updateBlocklist(jid types.JID, action events.BlocklistChangeAction) (jids []types.JID, err error) {
+	// whatsmeow reads the response of the update even if the query failed without one, e.g.
+	// because the connection was lost, which panics instead of returning an error.
+	defer func() {
+		if r := recover(); r != nil {
+			jids, err = nil, fmt.Errorf("blocklist update failed: %v", r)
+		}
+	}()
+	list, err := cli.UpdateBlocklist(jid.ToNonAD(), action)
+	var missing *whatsmeow.ElementMissingError
+	if errors.As(err, &missing) {
+		// Some servers don't include the updated list in the response.
+		return fetchBlocklist()
+	} else if err != nil {
+		return nil, err
+	}
+	return storeBlocklist(list), nil
+}
+
+// Refresh the cached blocklist after connecting.
+func refreshBlocklist() {
+	jids, err := fetchBlocklist()
+	if err != nil {
+		log.Errorf("Failed to fetch blocklist: %v", err)
+		return
+	}
+	log.Infof("Fetched blocklist: %d blocked JIDs", len(jids))
+}
+
+// Apply a blocklist change notification, e.g. from blocking a contact on the phone, to the
+// cached blocklist. Notifications without changes mean the whole list has to be fetched again.
+func handleBlocklistChange(evt *events.Blocklist) {
+	if evt.Action == events.BlocklistActionModify || len(evt.Changes) == 0 {
+		refreshBlocklist()
+		return
+	}
+	blocklistMu.Lock()
+	for _, change := range evt.Changes {
+		switch change.Action {
+		case events.BlocklistChangeActionBlock:
+			blocklist[change.JID.ToNonAD()] = struct{}{}
+		case events.BlocklistChangeActionUnblock:
+			delete(blocklist, change.JID.ToNonAD())
+		}
+	}
+	blocklistMu.Unlock()
+	log.Infof("Applied %d blocklist changes", len(evt.Changes))
+}
+
+func handleGetBlocklist() {
+	jids, err := fetchBlocklist()
+	if err != nil {
+		log.Errorf("Failed to fetch blocklist: %v", err)
+		sendReply("getblocklist", nil, err)
+		return
+	}
+	sendReply("getblocklist", jids, nil)
+}
+
+func handleUpdateBlocklist(cmd string, args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: %s <jid>", cmd)
+		sendReply(cmd, nil, fmt.Errorf("usage: %s <jid>", cmd))
+		return
+	}
+
+	jid, err := parseJID(args[0])
+	if err != nil {
+		sendReply(cmd, nil, err)
+		return
+	}
+
+	jids, err := updateBlocklist(jid, events.BlocklistChangeAction(cmd))
+	if err != nil {
+		log.Errorf("Failed to %s %s: %v", cmd, jid, err)
+		sendReply(cmd, nil, err)
+		return
+	}
+
+	log.Infof("%s %s", cmd, jid)
+	sendReply(cmd, jids, nil)
+}
+
+// Privacy setting names and the values the server accepts for each of them.
+var privacySettingValues = map[string][]types.PrivacySetting{
+	"groupadd":     {types.PrivacySettingAll, types.PrivacySettingContacts, "contact_blacklist"},
+	"last":         {types.PrivacySettingAll, types.PrivacySettingContacts, "contact_blacklist", types.PrivacySettingNone},
+	"status":       {types.PrivacySettingAll, types.PrivacySettingContacts, "contact_blacklist", types.PrivacySettingNone},
+	"profile":      {types.PrivacySettingAll, types.PrivacySettingContacts, "contact_blacklist", types.PrivacySettingNone},
+	"readreceipts": {types.PrivacySettingAll, types.PrivacySettingNone},
+}
+
+func handleGetPrivacy() {
+	settings, err := cli.TryFetchPrivacySettings(true)
+	if err != nil {
+		log.Errorf("Failed to fetch privacy settings: %v", err)
+		sendReply("getprivacy", nil, err)
+		return
+	}
+	sendReply("getprivacy", settings, nil)
+}
+
+func handleSetPrivacy(args []string) {
+	if len(args) < 2 {
+		log.Errorf("Usage: setprivacy <groupadd|last|status|profile|readreceipts> <value>")
+		sendReply("setprivacy", nil, fmt.Errorf("usage: setprivacy <groupadd|last|status|profile|readreceipts> <value>"))
+		return
+	}
+
+	name, value := args[0], types.PrivacySetting(args[1])
+	allowed, ok := privacySettingValues[name]
+	if !ok {
+		sendReply("setprivacy", nil, fmt.Errorf("unknown privacy setting %q", name))
+		return
+	}
+	valid := false
+	for _, v := range allowed {
+		if v == value {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		sendReply("setprivacy", nil, fmt.Errorf("invalid value %q for privacy setting %q, expected one of %v", value, name, allowed))
+		return
+	}
+
+	_, err := cli.DangerousInternals().SendIQ(whatsmeow.DangerousInfoQuery{
+		Namespace: "privacy",
+		Type:      "set",
+		To:        types.ServerJID,
+		Content: []waBinary.Node{{
+			Tag: "privacy",
+			Content: []waBinary.Node{{
+				Tag:   "category",
+				Attrs: waBinary.Attrs{"name": name, "value": string(value)},
+			}},
+		}},
+	})
+	if err != nil {
+		log.Errorf("Failed to set privacy setting %s: %v", name, err)
+		sendReply("setprivacy", nil, err)
+		return
+	}
+
+	log.Infof("Set privacy setting %s to %s", name, value)
+	settings, err := cli.TryFetchPrivacySettings(true)
+	if err != nil {
+		log.Errorf("Failed to fetch privacy settings: %v", err)
+		sendReply("setprivacy", nil, err)
+		return
+	}
+	sendReply("setprivacy", settings, nil)
+}
+
+func handlePrivacySettings(evt *events.PrivacySettings) {
+	log.Infof("Privacy settings changed: %+v", evt.NewSettings)
+	sendReply("getprivacy", evt.NewSettings, nil)
+}
@@ -1,19 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
-	"mime"
-	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/disintegration/imaging"
 	"go.mau.fi/whatsmeow"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -22,71 +18,124 @@ func handleIsLoggedIn() {
 	log.Infof("Logged in: %t", cli.IsLoggedIn())
 }
 
-func handleCheckUser(args []string) {
-	log.Infof("Checking users: %v", args)
-	if len(args) < 1 {
-		log.Errorf("Usage: checkuser <phone numbers...>")
+func handleSendTextMessage(args []string, userID int) {
+	if len(args) < 2 {
+		log.Errorf("Usage: send <jid> <text>")
+		sendReply("sendmessage", nil, fmt.Errorf("usage: send <jid> <text>"))
 		return
 	}
 
-	resp, err := cli.IsOnWhatsApp(args)
+	recipient, err := parseJID(args[0])
 	if err != nil {
-		log.Errorf("Failed to check if users are on WhatsApp: %v", err)
+		sendReply("sendmessage", nil, err)
 		return
 	}
 
-	for _, item := range resp {
-		logMessage := fmt.Sprintf("%s: on WhatsApp: %t, JID: %s", item.Query, item.IsIn, item.JID)
+	if isBlocked(recipient) {
+		log.Errorf("Refusing to send message to blocked JID %s", recipient)
+		sendReply("sendmessage", nil, fmt.Errorf("recipient %s is blocked", recipient))
+		return
+	}
 
-		if item.VerifiedName != nil {
-			logMessage += fmt.Sprintf(", business name: %s", item.VerifiedName.Details.GetVerifiedName())
-		}
+	msg := &waProto.Message{
+		Conversation: proto.String(strings.Join(args[1:], " ")),
+	}
+	log.Infof("Sending text message to %s", recipient)
 
-		log.Infof(logMessage)
+	resp, err := cli.SendMessage(context.Background(), recipient, msg)
+	if err != nil {
+		log.Errorf("Error sending message: %v", err)
+		sendReply("sendmessage", nil, err)
+		return
+	}
 
-		// Send response to websocket
-		if wsConn != nil {
-			wsConn.WriteJSON(item)
-		}
+	log.Infof("Message sent (server timestamp: %s)", resp.Timestamp)
+
+	if err := insertMessages(resp.ID, cli.Store.ID.String(), recipient.String(), cli.Store.ID.ToNonAD().String(), cli.Store.PushName, msg.GetConversation(), "text", resp.Timestamp, true, "", userID); err != nil {
+		log.Errorf("Error inserting into messages: %v", err)
 	}
+
+	if err := insertLastMessages(resp.ID, cli.Store.ID.String(), recipient.String(), cli.Store.ID.ToNonAD().String(), cli.Store.PushName, msg.GetConversation(), "text", resp.Timestamp, true, "", userID); err != nil {
+		log.Errorf("Error inserting into last_messages: %v", err)
+	}
+
+	writeWS(Message{resp.ID, recipient.String(), "text", msg.GetConversation(), true, "", cli.Store.ID.ToNonAD().String(), cli.Store.PushName})
 }
 
-func handleSendTextMessage(args []string, userID int) {
-	if len(args) < 2 {
-		log.Errorf("Usage: send <jid> <text>")
+func handlePostStatus(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: poststatus <text>")
+		sendReply("poststatus", nil, fmt.Errorf("usage: poststatus <text>"))
 		return
 	}
 
-	recipient, ok := parseJID(args[0])
-	if !ok {
+	msg := &waProto.Message{
+		ExtendedTextMessage: &waProto.ExtendedTextMessage{
+			Text: proto.String(strings.Join(args, " ")),
+		},
+	}
+	resp, err := cli.SendMessage(context.Background(), types.StatusBroadcastJID, msg)
+	if err != nil {
+		log.Errorf("Error posting status: %v", err)
+		sendReply("poststatus", nil, err)
 		return
 	}
 
-	msg := &waProto.Message{
-		Conversation: proto.String(strings.Join(args[1:], " ")),
+	log.Infof("Status posted (server timestamp: %s)", resp.Timestamp)
+
+	if err := insertStatus(resp.ID, cli.Store.ID.ToNonAD().String(), cli.Store.PushName, msg.GetExtendedTextMessage().GetText(), "text", resp.Timestamp, resp.Timestamp.Add(statusLifetime), ""); err != nil {
+		log.Errorf("Error inserting into statuses: %v", err)
 	}
-	log.Infof("Sending message to %s: %s", recipient, msg.GetConversation())
 
-	resp, err := cli.SendMessage(context.Background(), recipient, msg)
+	sendReply("poststatus", map[string]interface{}{"message_id": resp.ID, "timestamp": resp.Timestamp}, nil)
+}
+
+func handlePostStatusImage(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: poststatusimage <base64 image> [caption]")
+		sendReply("poststatusimage", nil, fmt.Errorf("usage: poststatusimage <base64 image> [caption]"))
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(args[0])
 	if err != nil {
-		log.Errorf("Error sending message: %v", err)
+		log.Errorf("Invalid image data: %v", err)
+		sendReply("poststatusimage", nil, fmt.Errorf("invalid image data: %w", err))
 		return
 	}
 
-	log.Infof("Message sent (server timestamp: %s)", resp.Timestamp)
+	image, err := prepareImage(data)
+	if err != nil {
+		log.Errorf("Invalid image data: %v", err)
+		sendReply("poststatusimage", nil, err)
+		return
+	}
 
-	if err := insertMessages(resp.ID, cli.Store.ID.String(), recipient.String(), msg.GetConversation(), "text", resp.Timestamp, true, "", userID); err != nil {
-		log.Errorf("Error inserting into messages: %v", err)
+	uploaded, err := uploadMedia(image.Data, whatsmeow.MediaImage)
+	if err != nil {
+		log.Errorf("Failed to upload status image: %v", err)
+		sendReply("poststatusimage", nil, err)
+		return
 	}
 
-	if err := insertLastMessages(resp.ID, cli.Store.ID.String(), recipient.String(), msg.GetConversation(), "text", resp.Timestamp, true, "", userID); err != nil {
-		log.Errorf("Error inserting into last_messages: %v", err)
+	msg := createImageMessage(uploaded, image)
+	msg.ImageMessage.Caption = proto.String(strings.Join(args[1:], " "))
+	resp, err := cli.SendMessage(context.Background(), types.StatusBroadcastJID, msg)
+	if err != nil {
+		log.Errorf("Error posting status: %v", err)
+		sendReply("poststatusimage", nil, err)
+		return
 	}
 
-	if wsConn != nil {
-		m := Message{resp.ID, recipient.String(), "text", msg.GetConversation(), true, ""}
-		wsConn.WriteJSON(m)
+	log.Infof("Image status posted (server timestamp: %s)", resp.Timestamp)
+
+	saveImage(msg, image.Data, resp.ID, types.StatusBroadcastJID.String())
+
+	if err := insertStatus(resp.ID, cli.Store.ID.ToNonAD().String(), cli.Store.PushName, msg.GetImageMessage().GetCaption(), "media", resp.Timestamp, resp.Timestamp.Add(statusLifetime), ""); err != nil {
+		log.Errorf("Error inserting into statuses: %v", err)
 	}
+
+	sendReply("poststatusimage", map[string]interface{}{"message_id": resp.ID, "timestamp": resp.Timestamp}, nil)
 }
 
 func handleMarkRead(args []string) {
@@ -103,8 +152,8 @@ func handleMarkRead(args []string) {
 		return
 	}
 
-	sender, ok := parseJID(remoteJID)
-	if !ok {
+	sender, err := parseJID(remoteJID)
+	if err != nil {
 		return
 	}
 
@@ -121,170 +170,382 @@ func handleMarkRead(args []string) {
 	}
 }
 
-func handleSendImage(JID string, userID int, data []byte) error {
-	recipient, ok := parseJID(JID)
-	if !ok {
-		return fmt.Errorf("invalid JID")
+func handleGetMessages(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: getmessages <jid> [limit] [offset]")
+		sendReply("getmessages", nil, fmt.Errorf("usage: getmessages <jid> [limit] [offset]"))
+		return
+	}
+
+	jid, err := parseJID(args[0])
+	if err != nil {
+		sendReply("getmessages", nil, err)
+		return
+	}
+	limit, offset, err := parseLimitOffset(argAt(args, 1), argAt(args, 2))
+	if err != nil {
+		sendReply("getmessages", nil, err)
+		return
+	}
+
+	messages, err := listMessages(jid.String(), limit, offset)
+	if err != nil {
+		log.Errorf("Failed to list messages: %v", err)
+		sendReply("getmessages", nil, err)
+		return
+	}
+	sendReply("getmessages", messages, nil)
+}
+
+// Options of outgoing media messages.
+type sendOptions struct {
+	Caption     string
+	ContextInfo *waProto.ContextInfo // Quoted message and mentions, if any
+}
+
+// Create the context info of a message to a chat that quotes the message of that chat with ID
+// replyTo, if it isn't empty, and mentions the given JIDs. It returns nil if there is nothing to
+// quote or mention.
+func createContextInfo(chat types.JID, replyTo string, mentions []types.JID) (*waProto.ContextInfo, error) {
+	if replyTo == "" && len(mentions) == 0 {
+		return nil, nil
+	}
+	info := &waProto.ContextInfo{}
+	if replyTo != "" {
+		quoted, err := getMessage(chat.String(), replyTo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get quoted message %s: %w", replyTo, err)
+		}
+		info.StanzaId = proto.String(quoted.MessageID)
+		if participant := quotedParticipant(chat, quoted); participant != "" {
+			info.Participant = proto.String(participant)
+		}
+		info.QuotedMessage = createQuotedMessage(quoted)
+	}
+	for _, jid := range mentions {
+		info.MentionedJid = append(info.MentionedJid, jid.String())
+	}
+	return info, nil
+}
+
+// Get the JID of the sender of a quoted message. Messages stored without their sender were sent
+// by the user, or by the other party of a 1:1 chat. In groups, it is unknown then, and empty.
+func quotedParticipant(chat types.JID, quoted *Message) string {
+	switch {
+	case quoted.SenderJID != "":
+		return quoted.SenderJID
+	case quoted.Sent:
+		return cli.Store.ID.ToNonAD().String()
+	case chat.Server != types.GroupServer:
+		return chat.ToNonAD().String()
+	}
+	return ""
+}
+
+// Create the quoted message of a stored message, of the same type as the message, so that
+// recipients see its preview. Media messages are created from their stored media, including
+// its thumbnail, and other messages as text.
+func createQuotedMessage(msg *Message) *waProto.Message {
+	if msg.Type == "media" {
+		media, err := getMedia(msg.MessageID)
+		if err != nil {
+			log.Warnf("Failed to get media of quoted message %s: %v", msg.MessageID, err)
+		} else {
+			var thumbnail []byte
+			if media.ThumbnailKey != "" {
+				if thumbnail, err = readMedia(media.ThumbnailKey); err != nil {
+					log.Warnf("Failed to read thumbnail of quoted message %s: %v", msg.MessageID, err)
+				}
+			}
+			mimeType := proto.String(media.MimeType)
+			switch media.MediaType {
+			case "image":
+				return &waProto.Message{ImageMessage: &waProto.ImageMessage{Mimetype: mimeType, Caption: proto.String(msg.Body), JpegThumbnail: thumbnail}}
+			case "video":
+				return &waProto.Message{VideoMessage: &waProto.VideoMessage{Mimetype: mimeType, Caption: proto.String(msg.Body), JpegThumbnail: thumbnail}}
+			case "audio":
+				return &waProto.Message{AudioMessage: &waProto.AudioMessage{Mimetype: mimeType}}
+			case "sticker":
+				return &waProto.Message{StickerMessage: &waProto.StickerMessage{Mimetype: mimeType}}
+			case "document":
+				return &waProto.Message{DocumentMessage: &waProto.DocumentMessage{Mimetype: mimeType, FileName: proto.String(media.FileName), Caption: proto.String(msg.Body), JpegThumbnail: thumbnail}}
+			}
+		}
 	}
+	return &waProto.Message{Conversation: proto.String(msg.Body)}
+}
 
-	uploaded, err := cli.Upload(context.Background(), data, whatsmeow.MediaImage)
+// Send an image and return the ID of its message.
+func handleSendImage(JID string, userID int, data []byte, opts sendOptions) (string, error) {
+	recipient, err := parseJID(JID)
 	if err != nil {
-		return fmt.Errorf("failed to upload file: %v", err)
+		return "", err
+	}
+
+	if isBlocked(recipient) {
+		return "", fmt.Errorf("recipient %s is blocked", recipient)
 	}
 
-	msg := createImageMessage(uploaded, &data)
+	image, err := prepareImage(data)
+	if err != nil {
+		return "", err
+	}
+
+	uploaded, err := uploadMedia(image.Data, whatsmeow.MediaImage)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload file: %v", err)
+	}
+
+	msg := createImageMessage(uploaded, image)
+	if opts.Caption != "" {
+		msg.ImageMessage.Caption = proto.String(opts.Caption)
+	}
+	msg.ImageMessage.ContextInfo = opts.ContextInfo
 	resp, err := cli.SendMessage(context.Background(), recipient, msg)
 	if err != nil {
-		return fmt.Errorf("error sending image message: %v", err)
+		return "", fmt.Errorf("error sending image message: %v", err)
 	}
 
 	log.Infof("Image message sent (server timestamp: %s)", resp.Timestamp)
 
-	if err := insertMessages(resp.ID, cli.Store.ID.String(), recipient.String(), "", "media", resp.Timestamp, true, "", userID); err != nil {
-		return fmt.Errorf("error inserting into messages: %v", err)
+	if err := insertMessages(resp.ID, cli.Store.ID.String(), recipient.String(), cli.Store.ID.ToNonAD().String(), cli.Store.PushName, opts.Caption, "media", resp.Timestamp, true, "", userID); err != nil {
+		return "", fmt.Errorf("error inserting into messages: %v", err)
 	}
 
-	if err := insertLastMessages(resp.ID, cli.Store.ID.String(), recipient.String(), "", "media", resp.Timestamp, true, "", userID); err != nil {
-		return fmt.Errorf("error inserting into last_messages: %v", err)
+	if err := insertLastMessages(resp.ID, cli.Store.ID.String(), recipient.String(), cli.Store.ID.ToNonAD().String(), cli.Store.PushName, opts.Caption, "media", resp.Timestamp, true, "", userID); err != nil {
+		return "", fmt.Errorf("error inserting into last_messages: %v", err)
 	}
 
-	saveImageToDisk(msg, data, resp.ID)
+	saveImage(msg, image.Data, resp.ID, recipient.String())
 
-	if wsConn != nil {
-		m := Message{resp.ID, recipient.String(), "media", "", true, ""}
-		wsConn.WriteJSON(m)
-	}
+	writeWS(Message{resp.ID, recipient.String(), "media", opts.Caption, true, "", cli.Store.ID.ToNonAD().String(), cli.Store.PushName})
 
-	return nil
+	return resp.ID, nil
 }
 
-func handleSendDocument(JID string, fileName string, userID int, data []byte) error {
-	recipient, ok := parseJID(JID)
-	if !ok {
-		return fmt.Errorf("invalid JID")
+// Send a document and return the ID of its message.
+func handleSendDocument(JID string, fileName string, userID int, data []byte, opts sendOptions) (string, error) {
+	recipient, err := parseJID(JID)
+	if err != nil {
+		return "", err
+	}
+
+	if isBlocked(recipient) {
+		return "", fmt.Errorf("recipient %s is blocked", recipient)
 	}
 
-	uploaded, err := cli.Upload(context.Background(), data, whatsmeow.MediaDocument)
+	uploaded, err := uploadMedia(data, whatsmeow.MediaDocument)
 	if err != nil {
-		return fmt.Errorf("failed to upload file: %v", err)
+		return "", fmt.Errorf("failed to upload file: %v", err)
 	}
 
-	msg := createDocumentMessage(fileName, uploaded, &data)
+	msg := createDocumentMessage(uploaded, prepareDocument(fileName, data))
+	if opts.Caption != "" {
+		msg.DocumentMessage.Caption = proto.String(opts.Caption)
+	}
+	msg.DocumentMessage.ContextInfo = opts.ContextInfo
 	resp, err := cli.SendMessage(context.Background(), recipient, msg)
 	if err != nil {
-		return fmt.Errorf("error sending document message: %v", err)
+		return "", fmt.Errorf("error sending document message: %v", err)
 	}
 
 	log.Infof("Document message sent (server timestamp: %s)", resp.Timestamp)
 
-	if err := insertMessages(resp.ID, cli.Store.ID.String(), recipient.String(), "", "media", resp.Timestamp, true, fileName, userID); err != nil {
-		return fmt.Errorf("error inserting into messages: %v", err)
+	if err := insertMessages(resp.ID, cli.Store.ID.String(), recipient.String(), cli.Store.ID.ToNonAD().String(), cli.Store.PushName, opts.Caption, "media", resp.Timestamp, true, fileName, userID); err != nil {
+		return "", fmt.Errorf("error inserting into messages: %v", err)
 	}
 
-	if err := insertLastMessages(resp.ID, cli.Store.ID.String(), recipient.String(), "", "media", resp.Timestamp, true, fileName, userID); err != nil {
-		return fmt.Errorf("error inserting into last_messages: %v", err)
+	if err := insertLastMessages(resp.ID, cli.Store.ID.String(), recipient.String(), cli.Store.ID.ToNonAD().String(), cli.Store.PushName, opts.Caption, "media", resp.Timestamp, true, fileName, userID); err != nil {
+		return "", fmt.Errorf("error inserting into last_messages: %v", err)
 	}
 
-	saveDocumentToDisk(msg, data, resp.ID)
+	saveDocument(msg, data, resp.ID, recipient.String())
 
-	if wsConn != nil {
-		m := Message{resp.ID, recipient.String(), "media", "", true, fileName}
-		wsConn.WriteJSON(m)
-	}
+	writeWS(Message{resp.ID, recipient.String(), "media", opts.Caption, true, fileName, cli.Store.ID.ToNonAD().String(), cli.Store.PushName})
 
-	return nil
+	return resp.ID, nil
 }
 
-func saveImageToDisk(msg *waProto.Message, data []byte, ID string) {
-	exts, err := mime.ExtensionsByType(msg.GetImageMessage().GetMimetype())
+func handleSendVideo(JID string, userID int, data []byte, mimeType string, opts sendOptions) (string, error) {
+	recipient, err := parseJID(JID)
 	if err != nil {
-		log.Errorf("Error getting file extension: %v", err)
-		return
+		return "", err
 	}
 
-	if len(exts) == 0 {
-		log.Errorf("No file extension found for mimetype: %s", msg.GetImageMessage().GetMimetype())
-		return
+	if isBlocked(recipient) {
+		return "", fmt.Errorf("recipient %s is blocked", recipient)
 	}
 
-	extension := exts[0]
-	path := fmt.Sprintf("%s%s", ID, extension)
+	uploaded, err := uploadMedia(data, whatsmeow.MediaVideo)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload file: %v", err)
+	}
 
-	err = os.WriteFile(path, data, 0644)
+	thumbnail, err := createThumbnail("video", data, nil)
 	if err != nil {
-		log.Errorf("Error saving file to disk: %v", err)
-		return
+		log.Warnf("Failed to create thumbnail of video: %v", err)
+	}
+	msg := &waProto.Message{
+		VideoMessage: &waProto.VideoMessage{
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(mimeType),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(data))),
+			JpegThumbnail: thumbnail,
+			ContextInfo:   opts.ContextInfo,
+		},
+	}
+	if opts.Caption != "" {
+		msg.VideoMessage.Caption = proto.String(opts.Caption)
+	}
+	return sendMediaMessage(recipient, msg, "video", mimeType, opts.Caption, userID, data, thumbnail)
+}
+
+// Audio messages have no caption, so the caption of an audio file is not sent.
+func handleSendAudio(JID string, userID int, data []byte, mimeType string, opts sendOptions) (string, error) {
+	recipient, err := parseJID(JID)
+	if err != nil {
+		return "", err
+	}
+
+	if isBlocked(recipient) {
+		return "", fmt.Errorf("recipient %s is blocked", recipient)
 	}
 
-	img, err := imaging.Decode(bytes.NewReader(data))
+	uploaded, err := uploadMedia(data, whatsmeow.MediaAudio)
 	if err != nil {
-		log.Errorf("Error decoding image: %v", err)
-		return
+		return "", fmt.Errorf("failed to upload file: %v", err)
 	}
 
-	thumbnail := imaging.Thumbnail(img, 100, 100, imaging.Lanczos)
+	if opts.Caption != "" {
+		log.Warnf("Audio messages can't have a caption, not sending it")
+	}
+	msg := &waProto.Message{
+		AudioMessage: &waProto.AudioMessage{
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(mimeType),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(data))),
+			ContextInfo:   opts.ContextInfo,
+		},
+	}
+	return sendMediaMessage(recipient, msg, "audio", mimeType, "", userID, data, nil)
+}
 
-	thumbnailPath := fmt.Sprintf("%s%s", ID, ".jpg")
-	err = imaging.Save(thumbnail, thumbnailPath, imaging.JPEGQuality(20))
+// Send a video or audio message, then log and store it like other sent media.
+func sendMediaMessage(recipient types.JID, msg *waProto.Message, kind, mimeType, caption string, userID int, data, thumbnail []byte) (string, error) {
+	resp, err := cli.SendMessage(context.Background(), recipient, msg)
 	if err != nil {
-		log.Errorf("Error saving thumbnail to disk: %v", err)
-		return
+		return "", fmt.Errorf("error sending %s message: %v", kind, err)
+	}
+
+	log.Infof("Sent %s message (server timestamp: %s)", kind, resp.Timestamp)
+
+	if err := insertMessages(resp.ID, cli.Store.ID.String(), recipient.String(), cli.Store.ID.ToNonAD().String(), cli.Store.PushName, caption, "media", resp.Timestamp, true, "", userID); err != nil {
+		return "", fmt.Errorf("error inserting into messages: %v", err)
+	}
+
+	if err := insertLastMessages(resp.ID, cli.Store.ID.String(), recipient.String(), cli.Store.ID.ToNonAD().String(), cli.Store.PushName, caption, "media", resp.Timestamp, true, "", userID); err != nil {
+		return "", fmt.Errorf("error inserting into last_messages: %v", err)
+	}
+
+	blob, err := storeBlob(data, mimeType)
+	if err != nil {
+		log.Errorf("Error saving file: %v", err)
+	} else {
+		media := Media{MessageID: resp.ID, RemoteJID: recipient.String(), StorageKey: blob.StorageKey, SHA256: blob.SHA256, MimeType: mimeType, Size: blob.Size, CreatedAt: time.Now(), Status: MediaAvailable, FromMe: true, MediaType: kind}
+		storeThumbnail(&media, nil, thumbnail)
+		if err := upsertMedia(media); err != nil {
+			log.Errorf("Error inserting into media: %v", err)
+		}
+		log.Infof("Saved file to %s", blob.StorageKey)
 	}
 
-	log.Infof("Saved file to %s", path)
-	log.Infof("Saved thumbnail to %s", thumbnailPath)
+	writeWS(Message{resp.ID, recipient.String(), "media", caption, true, "", cli.Store.ID.ToNonAD().String(), cli.Store.PushName})
+
+	return resp.ID, nil
 }
 
-func saveDocumentToDisk(msg *waProto.Message, data []byte, ID string) {
-	exts, err := mime.ExtensionsByType(msg.GetDocumentMessage().GetMimetype())
+func saveImage(msg *waProto.Message, data []byte, ID, remoteJID string) {
+	mimeType := msg.GetImageMessage().GetMimetype()
+
+	blob, err := storeBlob(data, mimeType)
 	if err != nil {
-		log.Errorf("Error getting file extension: %v", err)
+		log.Errorf("Error saving file: %v", err)
 		return
 	}
+	log.Infof("Saved file to %s", blob.StorageKey)
 
-	if len(exts) == 0 {
-		log.Errorf("No file extension found for mimetype: %s", msg.GetDocumentMessage().GetMimetype())
-		return
+	media := Media{MessageID: ID, RemoteJID: remoteJID, StorageKey: blob.StorageKey, SHA256: blob.SHA256, MimeType: mimeType, Size: blob.Size, CreatedAt: time.Now(), Status: MediaAvailable, FromMe: true, MediaType: "image"}
+	storeThumbnail(&media, data, nil)
+
+	if err := upsertMedia(media); err != nil {
+		log.Errorf("Error inserting into media: %v", err)
 	}
+}
 
-	extension := exts[0]
-	path := fmt.Sprintf("%s%s", ID, extension)
+func saveDocument(msg *waProto.Message, data []byte, ID, remoteJID string) {
+	mimeType := msg.GetDocumentMessage().GetMimetype()
 
-	err = os.WriteFile(path, data, 0644)
+	blob, err := storeBlob(data, mimeType)
 	if err != nil {
-		log.Errorf("Error saving file to disk: %v", err)
+		log.Errorf("Error saving file: %v", err)
 		return
 	}
 
-	log.Infof("Saved file to %s", path)
+	media := Media{MessageID: ID, RemoteJID: remoteJID, StorageKey: blob.StorageKey, SHA256: blob.SHA256, MimeType: mimeType, FileName: msg.GetDocumentMessage().GetFileName(), Size: blob.Size, CreatedAt: time.Now(), Status: MediaAvailable, FromMe: true, MediaType: "document"}
+	storeThumbnail(&media, data, msg.GetDocumentMessage().GetJpegThumbnail())
+	if err := upsertMedia(media); err != nil {
+		log.Errorf("Error inserting into media: %v", err)
+	}
+
+	log.Infof("Saved file to %s", blob.StorageKey)
 }
 
-func createImageMessage(uploaded whatsmeow.UploadResponse, data *[]byte) *waProto.Message {
+func createImageMessage(uploaded whatsmeow.UploadResponse, image *preparedImage) *waProto.Message {
 	return &waProto.Message{
 		ImageMessage: &waProto.ImageMessage{
 			Url:           proto.String(uploaded.URL),
 			DirectPath:    proto.String(uploaded.DirectPath),
 			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(*data)),
+			Mimetype:      proto.String("image/jpeg"),
 			FileEncSha256: uploaded.FileEncSHA256,
 			FileSha256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(*data))),
+			FileLength:    proto.Uint64(uint64(len(image.Data))),
+			Width:         proto.Uint32(uint32(image.Width)),
+			Height:        proto.Uint32(uint32(image.Height)),
+			JpegThumbnail: image.Thumbnail,
 		},
 	}
 }
 
-func createDocumentMessage(fileName string, uploaded whatsmeow.UploadResponse, data *[]byte) *waProto.Message {
-	return &waProto.Message{
+func createDocumentMessage(uploaded whatsmeow.UploadResponse, doc *preparedDocument) *waProto.Message {
+	msg := &waProto.Message{
 		DocumentMessage: &waProto.DocumentMessage{
-			FileName:      proto.String(fileName),
+			FileName:      proto.String(doc.FileName),
 			Url:           proto.String(uploaded.URL),
 			DirectPath:    proto.String(uploaded.DirectPath),
 			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(*data)),
+			Mimetype:      proto.String(doc.MimeType),
 			FileEncSha256: uploaded.FileEncSHA256,
 			FileSha256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(*data))),
-			Title:         proto.String(fmt.Sprintf("%s%s", "document", filepath.Ext(uploaded.URL))),
+			FileLength:    proto.Uint64(uint64(len(doc.Data))),
+			Title:         proto.String(doc.Title),
 		},
 	}
+	if doc.PageCount > 0 {
+		msg.DocumentMessage.PageCount = proto.Uint32(uint32(doc.PageCount))
+	}
+	if doc.Thumbnail != nil {
+		msg.DocumentMessage.JpegThumbnail = doc.Thumbnail
+		msg.DocumentMessage.ThumbnailWidth = proto.Uint32(uint32(doc.ThumbnailWidth))
+		msg.DocumentMessage.ThumbnailHeight = proto.Uint32(uint32(doc.ThumbnailHeight))
+	}
+	return msg
 }
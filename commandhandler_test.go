@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestQuotedParticipant(t *testing.T) {
+	user := types.NewJID("905321234567", types.DefaultUserServer)
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	sender := "905327654321@s.whatsapp.net"
+
+	tests := []struct {
+		name   string
+		chat   types.JID
+		quoted Message
+		want   string
+	}{
+		{name: "stored sender", chat: group, quoted: Message{SenderJID: sender}, want: sender},
+		{name: "1:1 chat without sender", chat: user, quoted: Message{}, want: user.String()},
+		{name: "group without sender", chat: group, quoted: Message{}, want: ""},
+	}
+	for _, tt := range tests {
+		if got := quotedParticipant(tt.chat, &tt.quoted); got != tt.want {
+			t.Errorf("%s: quotedParticipant() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const (
+	defaultContactsLimit = 100
+	maxContactsLimit     = 1000
+)
+
+// Mirror every contact in the whatsmeow store into the chat log database.
+func syncContacts() {
+	contacts, err := cli.Store.Contacts.GetAllContacts()
+	if err != nil {
+		log.Errorf("Failed to get contacts from store: %v", err)
+		return
+	}
+	for jid, info := range contacts {
+		if err := upsertContact(jid.String(), info); err != nil {
+			log.Errorf("Error upserting contact %s: %v", jid, err)
+		}
+	}
+	log.Infof("Synced %d contacts", len(contacts))
+}
+
+// Mirror a single contact from the whatsmeow store, which is updated before events are dispatched.
+func syncContact(jid types.JID) {
+	info, err := cli.Store.Contacts.GetContact(jid)
+	if err != nil {
+		log.Errorf("Failed to get contact %s from store: %v", jid, err)
+		return
+	}
+	if err := upsertContact(jid.ToNonAD().String(), info); err != nil {
+		log.Errorf("Error upserting contact %s: %v", jid, err)
+	}
+}
+
+func handlePushName(evt *events.PushName) {
+	log.Debugf("Push name of %s changed from %q to %q", evt.JID, evt.OldPushName, evt.NewPushName)
+	syncContact(evt.JID)
+}
+
+func handleContact(evt *events.Contact) {
+	log.Debugf("Contact %s changed: %+v", evt.JID, evt.Action)
+	syncContact(evt.JID)
+}
+
+func handleBusinessName(evt *events.BusinessName) {
+	log.Debugf("Business name of %s changed from %q to %q", evt.JID, evt.OldBusinessName, evt.NewBusinessName)
+	syncContact(evt.JID)
+}
+
+// Parse optional limit and offset values, applying defaults and bounds.
+func parseLimitOffset(limitStr, offsetStr string) (int, int, error) {
+	limit, offset := defaultContactsLimit, 0
+	var err error
+	if limitStr != "" {
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("invalid limit %q", limitStr)
+		}
+		if limit > maxContactsLimit {
+			limit = maxContactsLimit
+		}
+	}
+	if offsetStr != "" {
+		if offset, err = strconv.Atoi(offsetStr); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q", offsetStr)
+		}
+	}
+	return limit, offset, nil
+}
+
+// Return the argument at index i, or an empty string if it is missing.
+func argAt(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+func handleListContacts(args []string) {
+	limit, offset, err := parseLimitOffset(argAt(args, 0), argAt(args, 1))
+	if err != nil {
+		log.Errorf("Usage: listcontacts [limit] [offset]")
+		sendReply("listcontacts", nil, err)
+		return
+	}
+
+	contacts, err := listContacts("", limit, offset)
+	if err != nil {
+		log.Errorf("Failed to list contacts: %v", err)
+		sendReply("listcontacts", nil, err)
+		return
+	}
+	sendReply("listcontacts", contacts, nil)
+}
+
+func handleSearchContacts(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: searchcontacts <query>")
+		sendReply("searchcontacts", nil, fmt.Errorf("usage: searchcontacts <query>"))
+		return
+	}
+
+	contacts, err := listContacts(strings.Join(args, " "), defaultContactsLimit, 0)
+	if err != nil {
+		log.Errorf("Failed to search contacts: %v", err)
+		sendReply("searchcontacts", nil, err)
+		return
+	}
+	sendReply("searchcontacts", contacts, nil)
+}
+
+func handleGetContact(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: getcontact <jid>")
+		sendReply("getcontact", nil, fmt.Errorf("usage: getcontact <jid>"))
+		return
+	}
+
+	jid, err := parseJID(args[0])
+	if err != nil {
+		sendReply("getcontact", nil, err)
+		return
+	}
+
+	contact, err := getContact(jid.String())
+	if err != nil {
+		log.Errorf("Failed to get contact: %v", err)
+		sendReply("getcontact", nil, err)
+		return
+	}
+	sendReply("getcontact", contact, nil)
+}
+
+// ServeContacts lists and searches contacts on /contacts and returns a single contact on /contacts/{jid}.
+func serveContacts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var result interface{}
+	if arg := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/contacts"), "/"); arg != "" {
+		jid, err := parseJID(arg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		contact, err := getContact(jid.String())
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Contact not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to get contact", err)
+			return
+		}
+		result = contact
+	} else {
+		query := r.URL.Query()
+		limit, offset, err := parseLimitOffset(query.Get("limit"), query.Get("offset"))
+		if err != nil {
+			handleError(w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		contacts, err := listContacts(query.Get("q"), limit, offset)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to list contacts", err)
+			return
+		}
+		result = contacts
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Errorf("Failed to write contacts response: %v", err)
+	}
+}
@@ -1,50 +1,187 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
 )
 
 // InsertMessageHistory inserts a message history record into the database.
-func insertMessages(messageID, deviceJID, remoteJID, messageContent, messageType string, timestamp time.Time, sent bool, fileName string, userIDInteger int) error {
+func insertMessages(messageID, deviceJID, remoteJID, senderJID, pushName, messageContent, messageType string, timestamp time.Time, sent bool, fileName string, userIDInteger int) error {
 	var userID *int
 	if userIDInteger == -1 {
 		userID = nil
 	} else {
 		userID = &userIDInteger
 	}
+	content, contentKey := encryptContent(messageContent)
 	_, err := db.Exec(`
-		INSERT INTO messages (message_id, device_jid, remote_jid, type, content, timestamp, sent, file_name, user_id)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-    `, messageID, deviceJID, remoteJID, messageType, messageContent, timestamp, sent, fileName, userID)
+		INSERT INTO messages (message_id, device_jid, remote_jid, type, content, timestamp, sent, file_name, user_id, sender_jid, push_name, content_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+    `, messageID, deviceJID, remoteJID, messageType, content, timestamp, sent, fileName, userID, senderJID, pushName, contentKey)
 	if err != nil {
 		return fmt.Errorf("%w", err)
 	}
-	log.Infof("Inserted into messages: %d, %s, %s, %s, %s", messageID, deviceJID, remoteJID, messageContent, timestamp)
+	log.Infof("Inserted into messages: %s, %s, %s, %s", messageID, deviceJID, remoteJID, messageType)
 	return nil
 }
 
 // InsertOrUpdateLastMessage inserts or updates the last message for a remote JID in the database.
-func insertLastMessages(messageID, deviceJID, remoteJID, messageContent, messageType string, timestamp time.Time, sent bool, fileName string, userIDInteger int) error {
+func insertLastMessages(messageID, deviceJID, remoteJID, senderJID, pushName, messageContent, messageType string, timestamp time.Time, sent bool, fileName string, userIDInteger int) error {
 	var userID *int
 	if userIDInteger == -1 {
 		userID = nil
 	} else {
 		userID = &userIDInteger
 	}
+	content, contentKey := encryptContent(messageContent)
 	_, err := db.Exec(`
-		INSERT INTO last_messages (message_id, device_jid, remote_jid, type, content, timestamp, sent, file_name, user_id)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		INSERT INTO last_messages (message_id, device_jid, remote_jid, type, content, timestamp, sent, file_name, user_id, sender_jid, push_name, content_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 		ON CONFLICT (remote_jid)
-		DO UPDATE SET message_id = $1, device_jid = $2, type = $4, content = $5, timestamp = $6, sent = $7, file_name = $8, user_id = $9
-	`, messageID, deviceJID, remoteJID, messageType, messageContent, timestamp, sent, fileName, userID)
+		DO UPDATE SET message_id = $1, device_jid = $2, type = $4, content = $5, timestamp = $6, sent = $7, file_name = $8, user_id = $9, sender_jid = $10, push_name = $11, content_key = $12
+	`, messageID, deviceJID, remoteJID, messageType, content, timestamp, sent, fileName, userID, senderJID, pushName, contentKey)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	log.Infof("Inserted into last_messages: %s, %s, %s, %s", messageID, deviceJID, remoteJID, messageType)
+	return nil
+}
+
+// FlagMessage marks a message as flagged, e.g. because its media was quarantined.
+func flagMessage(messageID, reason string) error {
+	_, err := db.Exec(`
+		UPDATE messages SET flagged = true, flag_reason = $2 WHERE message_id = $1
+	`, messageID, reason)
 	if err != nil {
 		return fmt.Errorf("%w", err)
 	}
-	log.Infof("Inserted into last_messages: %d, %s, %s, %s, %s", messageID, deviceJID, remoteJID, messageContent, timestamp)
+	log.Infof("Flagged message %s: %s", messageID, reason)
 	return nil
 }
 
+// UnflagMessage clears the flag of a message, e.g. because its media was released from quarantine.
+func unflagMessage(messageID string) error {
+	_, err := db.Exec(`
+		UPDATE messages SET flagged = false, flag_reason = '' WHERE message_id = $1
+	`, messageID)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	log.Infof("Unflagged message %s", messageID)
+	return nil
+}
+
+// Decrypt the content of a message read with the hex ID of its key. Content that can't be
+// decrypted, e.g. because its key was removed, is logged and left empty rather than failing
+// the whole query.
+func decryptMessageBody(msg *Message, contentKey string) {
+	body, err := decryptContent(msg.Body, contentKey)
+	if err != nil {
+		log.Errorf("Failed to decrypt content of message %s: %v", msg.MessageID, err)
+	}
+	msg.Body = body
+}
+
+// ListMessages returns the messages of a chat, newest first, with their content decrypted.
+func listMessages(remoteJID string, limit, offset int) ([]Message, error) {
+	rows, err := db.Query(`
+		SELECT message_id, remote_jid, type, content, sent, file_name, sender_jid, push_name, content_key
+		FROM messages WHERE remote_jid = $1
+		ORDER BY timestamp DESC
+		LIMIT $2 OFFSET $3
+	`, remoteJID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var msg Message
+		var contentKey string
+		if err := rows.Scan(&msg.MessageID, &msg.Jid, &msg.Type, &msg.Body, &msg.Sent, &msg.FileName, &msg.SenderJID, &msg.PushName, &contentKey); err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		decryptMessageBody(&msg, contentKey)
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return messages, nil
+}
+
+// GetMessage gets a message of a chat by its ID.
+func getMessage(remoteJID, messageID string) (*Message, error) {
+	var msg Message
+	var contentKey string
+	err := db.QueryRow(`
+		SELECT message_id, remote_jid, type, content, sent, file_name, sender_jid, push_name, content_key
+		FROM messages WHERE remote_jid = $1 AND message_id = $2
+	`, remoteJID, messageID).Scan(&msg.MessageID, &msg.Jid, &msg.Type, &msg.Body, &msg.Sent, &msg.FileName, &msg.SenderJID, &msg.PushName, &contentKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	decryptMessageBody(&msg, contentKey)
+	return &msg, nil
+}
+
+// ReencryptContent encrypts the content of all messages and statuses that isn't encrypted with
+// the current key with it, and returns the number of rows updated. Content that can't be
+// decrypted is logged and skipped.
+func reencryptContent() (int, error) {
+	type storedContent struct {
+		MessageID, Content, Key string
+	}
+	updated := 0
+	for _, table := range []string{"messages", "last_messages", "statuses"} {
+		rows, err := db.Query(`
+			SELECT message_id, content, content_key FROM `+table+` WHERE content <> '' AND content_key <> $1
+		`, currentContentKey())
+		if err != nil {
+			return updated, fmt.Errorf("%w", err)
+		}
+		var contents []storedContent
+		for rows.Next() {
+			var c storedContent
+			if err := rows.Scan(&c.MessageID, &c.Content, &c.Key); err != nil {
+				rows.Close()
+				return updated, fmt.Errorf("%w", err)
+			}
+			contents = append(contents, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return updated, fmt.Errorf("%w", err)
+		}
+
+		for _, c := range contents {
+			plaintext, err := decryptContent(c.Content, c.Key)
+			if err != nil {
+				log.Errorf("Failed to decrypt content of %s in %s, skipping it: %v", c.MessageID, table, err)
+				continue
+			}
+			content, contentKey := encryptContent(plaintext)
+			result, err := db.Exec(`
+				UPDATE `+table+` SET content = $4, content_key = $5 WHERE message_id = $1 AND content = $2 AND content_key = $3
+			`, c.MessageID, c.Content, c.Key, content, contentKey)
+			if err != nil {
+				return updated, fmt.Errorf("%w", err)
+			}
+			n, _ := result.RowsAffected()
+			updated += int(n)
+		}
+	}
+	return updated, nil
+}
+
 func markMessageRead(messageID, remoteJID string, timestamp time.Time) error {
 	_, err := db.Exec(`
 		UPDATE messages SET read_at = $1 WHERE message_id = $2 AND remote_jid = $3
@@ -55,3 +192,753 @@ func markMessageRead(messageID, remoteJID string, timestamp time.Time) error {
 	log.Infof("Marked message as read: %d, %s, %s", messageID, remoteJID, timestamp)
 	return nil
 }
+
+// UpsertGroup inserts or updates the metadata of a group in the database.
+func upsertGroup(info *types.GroupInfo) error {
+	_, err := db.Exec(`
+		INSERT INTO groups (group_jid, device_jid, name, topic, owner_jid, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (group_jid)
+		DO UPDATE SET device_jid = $2, name = $3, topic = $4, owner_jid = $5, created_at = $6, updated_at = $7
+	`, info.JID.String(), cli.Store.ID.String(), info.Name, info.Topic, info.OwnerJID.String(), info.GroupCreated, time.Now())
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	log.Infof("Upserted group: %s, %s", info.JID, info.Name)
+	return nil
+}
+
+// ReplaceGroupParticipants replaces the stored participant list of a group.
+func replaceGroupParticipants(groupJID string, participants []types.GroupParticipant) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM group_participants WHERE group_jid = $1`, groupJID); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	for _, participant := range participants {
+		_, err := tx.Exec(`
+			INSERT INTO group_participants (group_jid, participant_jid, is_admin, is_super_admin)
+			VALUES ($1, $2, $3, $4)
+		`, groupJID, participant.JID.String(), participant.IsAdmin, participant.IsSuperAdmin)
+		if err != nil {
+			return fmt.Errorf("%w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	log.Infof("Replaced participants of %s: %d participants", groupJID, len(participants))
+	return nil
+}
+
+// UpsertGroupParticipant adds a participant to a group, or updates its admin flag if already present.
+func upsertGroupParticipant(groupJID, participantJID string, isAdmin bool) error {
+	_, err := db.Exec(`
+		INSERT INTO group_participants (group_jid, participant_jid, is_admin, is_super_admin)
+		VALUES ($1, $2, $3, false)
+		ON CONFLICT (group_jid, participant_jid)
+		DO UPDATE SET is_admin = $3
+	`, groupJID, participantJID, isAdmin)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+func deleteGroupParticipant(groupJID, participantJID string) error {
+	_, err := db.Exec(`
+		DELETE FROM group_participants WHERE group_jid = $1 AND participant_jid = $2
+	`, groupJID, participantJID)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+func updateGroupName(groupJID, name string) error {
+	_, err := db.Exec(`
+		UPDATE groups SET name = $1, updated_at = $2 WHERE group_jid = $3
+	`, name, time.Now(), groupJID)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+func updateGroupTopic(groupJID, topic string) error {
+	_, err := db.Exec(`
+		UPDATE groups SET topic = $1, updated_at = $2 WHERE group_jid = $3
+	`, topic, time.Now(), groupJID)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+// GroupInvite is a group invite received in a chat through a GroupInviteMessage.
+type GroupInvite struct {
+	MessageID  string     `json:"message_id"`
+	RemoteJID  string     `json:"remote_jid"`
+	GroupJID   string     `json:"group_jid"`
+	GroupName  string     `json:"group_name"`
+	InviterJID string     `json:"inviter_jid"`
+	Code       string     `json:"code"`
+	Expiration int64      `json:"expiration"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+}
+
+// InsertGroupInvite stores a received group invite so that it can be previewed or accepted later.
+func insertGroupInvite(invite GroupInvite) error {
+	_, err := db.Exec(`
+		INSERT INTO group_invites (message_id, device_jid, remote_jid, group_jid, group_name, inviter_jid, code, expiration)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (message_id) DO NOTHING
+	`, invite.MessageID, cli.Store.ID.String(), invite.RemoteJID, invite.GroupJID, invite.GroupName, invite.InviterJID, invite.Code, invite.Expiration)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	log.Infof("Inserted into group_invites: %s, %s, %s", invite.MessageID, invite.GroupJID, invite.InviterJID)
+	return nil
+}
+
+func getGroupInvite(messageID string) (*GroupInvite, error) {
+	var invite GroupInvite
+	err := db.QueryRow(`
+		SELECT message_id, remote_jid, group_jid, group_name, inviter_jid, code, expiration, accepted_at
+		FROM group_invites WHERE message_id = $1
+	`, messageID).Scan(&invite.MessageID, &invite.RemoteJID, &invite.GroupJID, &invite.GroupName, &invite.InviterJID, &invite.Code, &invite.Expiration, &invite.AcceptedAt)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return &invite, nil
+}
+
+func markGroupInviteAccepted(messageID string, timestamp time.Time) error {
+	_, err := db.Exec(`
+		UPDATE group_invites SET accepted_at = $1 WHERE message_id = $2
+	`, timestamp, messageID)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+// Status updates disappear from WhatsApp 24 hours after they are posted.
+const statusLifetime = 24 * time.Hour
+
+// InsertStatus inserts a status (story) update into the database, with its content encrypted.
+func insertStatus(messageID, senderJID, pushName, content, statusType string, timestamp, expiresAt time.Time, fileName string) error {
+	content, contentKey := encryptContent(content)
+	_, err := db.Exec(`
+		INSERT INTO statuses (message_id, device_jid, sender_jid, push_name, type, content, file_name, timestamp, expires_at, content_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (message_id) DO NOTHING
+	`, messageID, cli.Store.ID.String(), senderJID, pushName, statusType, content, fileName, timestamp, expiresAt, contentKey)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	log.Infof("Inserted into statuses: %s, %s, %s", messageID, senderJID, timestamp)
+	return nil
+}
+
+func purgeExpiredStatuses(now time.Time) error {
+	res, err := db.Exec(`
+		DELETE FROM statuses WHERE expires_at < $1
+	`, now)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Infof("Purged %d expired statuses", n)
+	}
+	return nil
+}
+
+// Contact is an entry of the contact directory mirrored from the whatsmeow store.
+type Contact struct {
+	JID          string    `json:"jid"`
+	FirstName    string    `json:"first_name"`
+	FullName     string    `json:"full_name"`
+	PushName     string    `json:"push_name"`
+	BusinessName string    `json:"business_name"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// UpsertContact inserts or updates a contact in the database.
+func upsertContact(jid string, info types.ContactInfo) error {
+	_, err := db.Exec(`
+		INSERT INTO contacts (jid, device_jid, first_name, full_name, push_name, business_name, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (jid)
+		DO UPDATE SET device_jid = $2, first_name = $3, full_name = $4, push_name = $5, business_name = $6, updated_at = $7
+	`, jid, cli.Store.ID.String(), info.FirstName, info.FullName, info.PushName, info.BusinessName, time.Now())
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+// Get a LIKE pattern that matches text containing s, escaping the wildcards in s with
+// backslashes.
+func containsPattern(s string) string {
+	return "%" + likeEscaper.Replace(s) + "%"
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// ListContacts returns contacts whose JID or names contain query, ordered by name.
+// An empty query lists all contacts.
+func listContacts(query string, limit, offset int) ([]Contact, error) {
+	rows, err := db.Query(`
+		SELECT jid, first_name, full_name, push_name, business_name, updated_at
+		FROM contacts
+		WHERE $1 = '' OR jid ILIKE $4 ESCAPE '\' OR full_name ILIKE $4 ESCAPE '\'
+			OR push_name ILIKE $4 ESCAPE '\' OR business_name ILIKE $4 ESCAPE '\'
+		ORDER BY COALESCE(NULLIF(full_name, ''), NULLIF(push_name, ''), NULLIF(business_name, ''), jid)
+		LIMIT $2 OFFSET $3
+	`, query, limit, offset, containsPattern(query))
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer rows.Close()
+
+	contacts := []Contact{}
+	for rows.Next() {
+		var contact Contact
+		if err := rows.Scan(&contact.JID, &contact.FirstName, &contact.FullName, &contact.PushName, &contact.BusinessName, &contact.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		contacts = append(contacts, contact)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return contacts, nil
+}
+
+func getContact(jid string) (*Contact, error) {
+	var contact Contact
+	err := db.QueryRow(`
+		SELECT jid, first_name, full_name, push_name, business_name, updated_at
+		FROM contacts WHERE jid = $1
+	`, jid).Scan(&contact.JID, &contact.FirstName, &contact.FullName, &contact.PushName, &contact.BusinessName, &contact.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return &contact, nil
+}
+
+// Avatar is a cached profile picture of a user or group.
+type Avatar struct {
+	JID        string    `json:"jid"`
+	PictureID  string    `json:"picture_id"`
+	StorageKey string    `json:"-"` // Media store key
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// UpsertAvatar inserts or updates the cached profile picture of a JID in the database.
+func upsertAvatar(avatar Avatar) error {
+	_, err := db.Exec(`
+		INSERT INTO avatars (jid, picture_id, storage_key, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (jid)
+		DO UPDATE SET picture_id = $2, storage_key = $3, updated_at = $4
+	`, avatar.JID, avatar.PictureID, avatar.StorageKey, avatar.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+func getAvatar(jid string) (*Avatar, error) {
+	var avatar Avatar
+	err := db.QueryRow(`
+		SELECT jid, picture_id, storage_key, updated_at FROM avatars WHERE jid = $1
+	`, jid).Scan(&avatar.JID, &avatar.PictureID, &avatar.StorageKey, &avatar.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return &avatar, nil
+}
+
+func deleteAvatar(jid string) error {
+	_, err := db.Exec(`
+		DELETE FROM avatars WHERE jid = $1
+	`, jid)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+// NumberCheck is the cached result of checking whether a phone number is on WhatsApp.
+type NumberCheck struct {
+	Query        string    `json:"query"`
+	IsIn         bool      `json:"is_in"`
+	JID          string    `json:"jid"`
+	VerifiedName string    `json:"verified_name,omitempty"`
+	CheckedAt    time.Time `json:"checked_at"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// GetNumberChecks returns the cached results for the given phone numbers that were checked after since.
+func getNumberChecks(queries []string, since time.Time) ([]NumberCheck, error) {
+	rows, err := db.Query(`
+		SELECT query, is_in, jid, verified_name, checked_at
+		FROM number_checks WHERE query = ANY($1) AND checked_at > $2
+	`, pq.Array(queries), since)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer rows.Close()
+
+	var checks []NumberCheck
+	for rows.Next() {
+		var check NumberCheck
+		if err := rows.Scan(&check.Query, &check.IsIn, &check.JID, &check.VerifiedName, &check.CheckedAt); err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		checks = append(checks, check)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return checks, nil
+}
+
+// UpsertNumberCheck inserts or updates the cached result for a phone number.
+func upsertNumberCheck(check NumberCheck) error {
+	_, err := db.Exec(`
+		INSERT INTO number_checks (query, is_in, jid, verified_name, checked_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (query)
+		DO UPDATE SET is_in = $2, jid = $3, verified_name = $4, checked_at = $5
+	`, check.Query, check.IsIn, check.JID, check.VerifiedName, check.CheckedAt)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+// Media is a media file stored for a message. Files with a known SHA-256 hash are stored
+// once as a MediaBlob and shared between all messages that contain them. The download
+// fields are kept so that files that weren't downloaded yet can be fetched on demand;
+// StorageKey is empty until then.
+type Media struct {
+	MessageID     string     `json:"message_id"`
+	RemoteJID     string     `json:"remote_jid"`
+	StorageKey    string     `json:"-"`
+	ThumbnailKey  string     `json:"-"`
+	SHA256        string     `json:"sha256,omitempty"`
+	MimeType      string     `json:"mimetype"`
+	FileName      string     `json:"file_name"`
+	Size          int64      `json:"size"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Status        string     `json:"status"`
+	RetryAt       *time.Time `json:"retry_at,omitempty"`
+	ScanResult    string     `json:"scan_result,omitempty"`
+	SenderJID     string     `json:"-"`
+	FromMe        bool       `json:"-"`
+	MediaType     string     `json:"-"`
+	DirectPath    string     `json:"-"`
+	MediaKey      []byte     `json:"-"`
+	FileEncSHA256 []byte     `json:"-"`
+	FileSHA256    []byte     `json:"-"`
+}
+
+// Media statuses. Pending media is not downloaded yet or is waiting for a media retry.
+const (
+	MediaPending     = "pending"
+	MediaAvailable   = "available"
+	MediaLost        = "lost"
+	MediaPurged      = "purged"
+	MediaQuarantined = "quarantined"
+	MediaUnscanned   = "unscanned"
+)
+
+// UpsertMedia inserts or updates the media record of a message in the database.
+// The reference count of the media blob is incremented when the record gets its hash, which is
+// only set once its file is stored.
+func upsertMedia(media Media) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	defer tx.Rollback()
+
+	var previous sql.NullString
+	err = tx.QueryRow(`
+		SELECT sha256 FROM media WHERE message_id = $1 FOR UPDATE
+	`, media.MessageID).Scan(&previous)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO media (message_id, device_jid, remote_jid, storage_key, thumbnail_key, sha256, mimetype, file_name, size, created_at,
+			status, sender_jid, from_me, media_type, direct_path, media_key, file_enc_sha256, scan_result, file_sha256)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
+		ON CONFLICT (message_id)
+		DO UPDATE SET storage_key = $4, thumbnail_key = $5, sha256 = COALESCE(NULLIF($6, ''), media.sha256), mimetype = $7, file_name = $8, size = $9,
+			status = $11, retry_at = CASE WHEN $11 = 'pending' THEN media.retry_at END, sender_jid = $12, from_me = $13, media_type = $14, direct_path = $15, media_key = $16, file_enc_sha256 = $17, scan_result = $18,
+			file_sha256 = COALESCE($19, media.file_sha256)
+	`, media.MessageID, cli.Store.ID.String(), media.RemoteJID, media.StorageKey, media.ThumbnailKey, media.SHA256, media.MimeType, media.FileName, media.Size, media.CreatedAt,
+		media.Status, media.SenderJID, media.FromMe, media.MediaType, media.DirectPath, media.MediaKey, media.FileEncSHA256, media.ScanResult, media.FileSHA256)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	if media.SHA256 != "" && media.SHA256 != previous.String {
+		_, err = tx.Exec(`
+			UPDATE media_blobs SET ref_count = ref_count + 1 WHERE sha256 = $1
+		`, media.SHA256)
+		if err != nil {
+			return fmt.Errorf("%w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+func getMedia(messageID string) (*Media, error) {
+	var media Media
+	err := db.QueryRow(`
+		SELECT `+mediaColumns+` FROM media WHERE message_id = $1
+	`, messageID).Scan(mediaFields(&media)...)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return &media, nil
+}
+
+const mediaColumns = `message_id, remote_jid, storage_key, thumbnail_key, COALESCE(sha256, ''), mimetype, file_name, size, created_at,
+	status, retry_at, sender_jid, from_me, media_type, direct_path, media_key, file_enc_sha256, scan_result, file_sha256`
+
+// Get the scan destinations of mediaColumns.
+func mediaFields(media *Media) []interface{} {
+	return []interface{}{&media.MessageID, &media.RemoteJID, &media.StorageKey, &media.ThumbnailKey, &media.SHA256, &media.MimeType, &media.FileName, &media.Size, &media.CreatedAt,
+		&media.Status, &media.RetryAt, &media.SenderJID, &media.FromMe, &media.MediaType, &media.DirectPath, &media.MediaKey, &media.FileEncSHA256, &media.ScanResult, &media.FileSHA256}
+}
+
+// ScheduleMediaRetry marks media as pending, schedules its next download attempt and returns the number of attempts so far.
+func scheduleMediaRetry(messageID string, retryAt time.Time) (int, error) {
+	var retries int
+	err := db.QueryRow(`
+		UPDATE media SET status = $2, retry_count = retry_count + 1, retry_at = $3 WHERE message_id = $1 RETURNING retry_count
+	`, messageID, MediaPending, retryAt).Scan(&retries)
+	if err != nil {
+		return 0, fmt.Errorf("%w", err)
+	}
+	return retries, nil
+}
+
+// ScheduleMediaScan marks media as pending and schedules its next download attempt without
+// counting it as a failed download, for files that couldn't be scanned. It returns the number
+// of failed scans so far.
+func scheduleMediaScan(messageID string, retryAt time.Time) (int, error) {
+	var attempts int
+	err := db.QueryRow(`
+		UPDATE media SET status = $2, scan_attempts = scan_attempts + 1, retry_at = $3 WHERE message_id = $1 RETURNING scan_attempts
+	`, messageID, MediaPending, retryAt).Scan(&attempts)
+	if err != nil {
+		return 0, fmt.Errorf("%w", err)
+	}
+	return attempts, nil
+}
+
+// SetMediaDirectPath updates the direct path media is downloaded from, e.g. after the phone
+// uploaded it again.
+func setMediaDirectPath(messageID, directPath string) error {
+	_, err := db.Exec(`
+		UPDATE media SET direct_path = $2 WHERE message_id = $1
+	`, messageID, directPath)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+func setMediaStatus(messageID, status string) error {
+	_, err := db.Exec(`
+		UPDATE media SET status = $2, retry_at = NULL WHERE message_id = $1
+	`, messageID, status)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	log.Infof("Media of %s is %s", messageID, status)
+	return nil
+}
+
+// GetDueMediaRetries returns pending media whose next download attempt is due.
+func getDueMediaRetries(now time.Time) ([]Media, error) {
+	rows, err := db.Query(`
+		SELECT `+mediaColumns+` FROM media WHERE status = $1 AND retry_at <= $2 ORDER BY retry_at
+	`, MediaPending, now)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer rows.Close()
+
+	var media []Media
+	for rows.Next() {
+		var m Media
+		if err := rows.Scan(mediaFields(&m)...); err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		media = append(media, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return media, nil
+}
+
+// ListStoredMedia returns all media whose file is stored, oldest first.
+func listStoredMedia() ([]Media, error) {
+	rows, err := db.Query(`
+		SELECT `+mediaColumns+` FROM media WHERE status = $1 AND storage_key <> '' ORDER BY created_at
+	`, MediaAvailable)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer rows.Close()
+
+	var media []Media
+	for rows.Next() {
+		var m Media
+		if err := rows.Scan(mediaFields(&m)...); err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		media = append(media, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return media, nil
+}
+
+// PurgeMedia marks the media of a message as purged and releases its blob. It returns the
+// storage keys of the files to delete: the thumbnail of the message, and the file and its
+// thumbnail unless the blob is still referenced elsewhere.
+func purgeMedia(media Media) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE media SET status = $2, storage_key = '', thumbnail_key = '', retry_at = NULL WHERE message_id = $1
+	`, media.MessageID, MediaPurged)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+
+	var deleteKeys []string
+	if media.ThumbnailKey != "" && (media.SHA256 == "" || media.ThumbnailKey != blobThumbnailKey(media.SHA256)) {
+		deleteKeys = append(deleteKeys, media.ThumbnailKey)
+	}
+	if media.SHA256 == "" {
+		deleteKeys = append(deleteKeys, media.StorageKey)
+	} else {
+		blobKeys, err := releaseMediaBlob(tx, media.SHA256, media.StorageKey)
+		if err != nil {
+			return nil, err
+		}
+		deleteKeys = append(deleteKeys, blobKeys...)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return deleteKeys, nil
+}
+
+// Decrement the reference count of a blob and delete it once it is no longer referenced. It
+// returns the storage keys of the blob file and its thumbnail if they have to be deleted.
+func releaseMediaBlob(tx *sql.Tx, sha256, storageKey string) ([]string, error) {
+	var refCount int
+	err := tx.QueryRow(`
+		UPDATE media_blobs SET ref_count = ref_count - 1 WHERE sha256 = $1 RETURNING ref_count
+	`, sha256).Scan(&refCount)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w", err)
+	}
+	if err == nil && refCount > 0 {
+		return nil, nil
+	}
+	if _, err = tx.Exec(`DELETE FROM media_blobs WHERE sha256 = $1`, sha256); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return []string{storageKey, blobThumbnailKey(sha256)}, nil
+}
+
+// ListBlobMedia returns the available media stored in the blob with the given hash.
+func listBlobMedia(sha256 string) ([]Media, error) {
+	rows, err := db.Query(`
+		SELECT `+mediaColumns+` FROM media WHERE sha256 = $1 AND status = $2
+	`, sha256, MediaAvailable)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer rows.Close()
+
+	var media []Media
+	for rows.Next() {
+		var m Media
+		if err := rows.Scan(mediaFields(&m)...); err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		media = append(media, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return media, nil
+}
+
+// QuarantineStoredMedia records that the stored media of a message was quarantined by a rescan
+// and releases its blob. It returns the storage keys of the files to delete, i.e. the blob file
+// and its thumbnail once the blob is no longer referenced.
+func quarantineStoredMedia(media Media, sha256, blobKey string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE media SET storage_key = $2, status = $3, scan_result = $4, size = $5, sha256 = NULL,
+			thumbnail_key = CASE WHEN thumbnail_key = $6 THEN '' ELSE thumbnail_key END
+		WHERE message_id = $1
+	`, media.MessageID, media.StorageKey, media.Status, media.ScanResult, media.Size, blobThumbnailKey(sha256))
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	deleteKeys, err := releaseMediaBlob(tx, sha256, blobKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return deleteKeys, nil
+}
+
+// MediaBlob is a media file stored once by its SHA-256 hash.
+type MediaBlob struct {
+	SHA256     string
+	StorageKey string
+	MimeType   string
+	Size       int64
+	RefCount   int
+	CreatedAt  time.Time
+}
+
+// ListMediaKeys returns the storage keys of all stored media files, thumbnails and profile pictures.
+func listMediaKeys() ([]string, error) {
+	rows, err := db.Query(`
+		SELECT storage_key FROM media WHERE storage_key <> ''
+		UNION SELECT thumbnail_key FROM media WHERE thumbnail_key <> ''
+		UNION SELECT storage_key FROM avatars WHERE storage_key <> ''
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return keys, nil
+}
+
+// ListMediaBlobs returns all media blobs by their hash.
+func listMediaBlobs() (map[string]MediaBlob, error) {
+	rows, err := db.Query(`
+		SELECT sha256, storage_key, mimetype, size, ref_count, created_at FROM media_blobs
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer rows.Close()
+
+	blobs := make(map[string]MediaBlob)
+	for rows.Next() {
+		var blob MediaBlob
+		if err := rows.Scan(&blob.SHA256, &blob.StorageKey, &blob.MimeType, &blob.Size, &blob.RefCount, &blob.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		blobs[blob.SHA256] = blob
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return blobs, nil
+}
+
+func getMediaBlob(sha256 string) (*MediaBlob, error) {
+	var blob MediaBlob
+	err := db.QueryRow(`
+		SELECT sha256, storage_key, mimetype, size, ref_count, created_at FROM media_blobs WHERE sha256 = $1
+	`, sha256).Scan(&blob.SHA256, &blob.StorageKey, &blob.MimeType, &blob.Size, &blob.RefCount, &blob.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return &blob, nil
+}
+
+// InsertMediaBlob records a stored media blob unless it already exists. Its reference count starts
+// at the number of media records that already reference it, e.g. files that were downloaded lazily.
+func insertMediaBlob(blob MediaBlob) error {
+	_, err := db.Exec(`
+		INSERT INTO media_blobs (sha256, storage_key, mimetype, size, ref_count, created_at)
+		VALUES ($1, $2, $3, $4, (SELECT count(*) FROM media WHERE sha256 = $1 AND status <> $6), $5)
+		ON CONFLICT (sha256) DO NOTHING
+	`, blob.SHA256, blob.StorageKey, blob.MimeType, blob.Size, blob.CreatedAt, MediaPurged)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
+
+// GetMediaUpload returns the response of a previous upload of the given content and media type
+// to WhatsApp, if it was uploaded after since.
+func getMediaUpload(sha256, mediaType string, since time.Time) (*whatsmeow.UploadResponse, error) {
+	var upload whatsmeow.UploadResponse
+	err := db.QueryRow(`
+		SELECT url, direct_path, media_key, file_enc_sha256, file_sha256, file_length
+		FROM media_uploads WHERE sha256 = $1 AND media_type = $2 AND uploaded_at > $3
+	`, sha256, mediaType, since).Scan(&upload.URL, &upload.DirectPath, &upload.MediaKey, &upload.FileEncSHA256, &upload.FileSHA256, &upload.FileLength)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return &upload, nil
+}
+
+// UpsertMediaUpload stores the response of uploading content of the given media type to WhatsApp.
+func upsertMediaUpload(sha256, mediaType string, upload whatsmeow.UploadResponse, uploadedAt time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO media_uploads (sha256, media_type, url, direct_path, media_key, file_enc_sha256, file_sha256, file_length, uploaded_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (sha256, media_type)
+		DO UPDATE SET url = $3, direct_path = $4, media_key = $5, file_enc_sha256 = $6, file_sha256 = $7, file_length = $8, uploaded_at = $9
+	`, sha256, mediaType, upload.URL, upload.DirectPath, upload.MediaKey, upload.FileEncSHA256, upload.FileSHA256, upload.FileLength, uploadedAt)
+	if err != nil {
+		return fmt.Errorf("%w", err)
+	}
+	return nil
+}
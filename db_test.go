@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestContainsPattern(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "%%"},
+		{"ali", "%ali%"},
+		{"_", `%\_%`},
+		{"100%", `%100\%%`},
+		{`a\b`, `%a\\b%`},
+		{`\_%`, `%\\\_\%%`},
+	}
+	for _, tt := range tests {
+		if got := containsPattern(tt.query); got != tt.want {
+			t.Errorf("containsPattern(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/jpeg" // Decoding the dimensions of rendered pages
+	"mime"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Documents are sent with their mimetype, corrected by their extension when it can't be detected
+// from their content, and a title taken from their file name. The first page of PDFs is rendered
+// as their preview with pdftoppm and their pages are counted with pdfinfo, if poppler is installed.
+
+const documentPreviewSize = 480 // Maximum width and height of rendered document previews
+
+// A document prepared to be sent.
+type preparedDocument struct {
+	Data            []byte
+	FileName        string
+	Title           string
+	MimeType        string
+	PageCount       int
+	Thumbnail       []byte
+	ThumbnailWidth  int
+	ThumbnailHeight int
+}
+
+// Get the mimetype of a document. When its content only matches a generic type, such as for
+// Office documents which are detected as ZIP files, the type of its extension is used instead.
+func documentMimeType(fileName string, data []byte) string {
+	detected := http.DetectContentType(data)
+	switch strings.SplitN(detected, ";", 2)[0] {
+	case "application/octet-stream", "application/zip", "text/plain", "text/xml":
+		if byExtension := mime.TypeByExtension(strings.ToLower(filepath.Ext(fileName))); byExtension != "" {
+			return byExtension
+		}
+	}
+	return detected
+}
+
+// Prepare a document to be sent, with a preview and page count if it is a PDF.
+func prepareDocument(fileName string, data []byte) *preparedDocument {
+	doc := &preparedDocument{
+		Data:     data,
+		FileName: fileName,
+		Title:    strings.TrimSuffix(fileName, filepath.Ext(fileName)),
+		MimeType: documentMimeType(fileName, data),
+	}
+	if doc.Title == "" {
+		doc.Title = fileName
+	}
+	if doc.MimeType != "application/pdf" {
+		return doc
+	}
+
+	path, cleanup, err := writeTempFile("document-*.pdf", data)
+	if err != nil {
+		log.Errorf("Error preparing PDF %s: %v", fileName, err)
+		return doc
+	}
+	defer cleanup()
+
+	doc.PageCount = countPDFPages(path, data)
+	if doc.Thumbnail, err = renderPDFPage(path); err != nil {
+		log.Debugf("No preview for PDF %s: %v", fileName, err)
+	} else if config, _, err := image.DecodeConfig(bytes.NewReader(doc.Thumbnail)); err == nil {
+		doc.ThumbnailWidth, doc.ThumbnailHeight = config.Width, config.Height
+	}
+	return doc
+}
+
+// Render the first page of a PDF as a JPEG with pdftoppm.
+func renderPDFPage(path string) ([]byte, error) {
+	pdftoppm, err := exec.LookPath("pdftoppm")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, pdftoppm, "-f", "1", "-l", "1", "-singlefile", "-jpeg", "-scale-to", strconv.Itoa(documentPreviewSize), path)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pdftoppm failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("pdftoppm produced no image")
+	}
+	return stdout.Bytes(), nil
+}
+
+var (
+	pdfInfoPages  = regexp.MustCompile(`(?m)^Pages:\s+(\d+)`)
+	pdfPageObject = regexp.MustCompile(`/Type\s*/Page[^s]`)
+)
+
+// Count the pages of a PDF with pdfinfo. Without it, page objects are counted, which misses
+// pages in compressed object streams, so 0 (unknown) is returned if none are found.
+func countPDFPages(path string, data []byte) int {
+	if pdfinfo, err := exec.LookPath("pdfinfo"); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		output, err := exec.CommandContext(ctx, pdfinfo, path).Output()
+		if match := pdfInfoPages.FindSubmatch(output); err == nil && match != nil {
+			pages, _ := strconv.Atoi(string(match[1]))
+			return pages
+		}
+		log.Debugf("pdfinfo failed, counting page objects: %v", err)
+	}
+	return len(pdfPageObject.FindAllIndex(data, -1))
+}
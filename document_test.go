@@ -0,0 +1,65 @@
+package main
+
+import (
+	"mime"
+	"testing"
+)
+
+func TestDocumentMimeType(t *testing.T) {
+	const docx = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	if err := mime.AddExtensionType(".docx", docx); err != nil {
+		t.Fatal(err)
+	}
+
+	pdf := []byte("%PDF-1.4\n")
+	png := []byte("\x89PNG\r\n\x1a\n")
+	zip := []byte("PK\x03\x04")
+	text := []byte(`{"name": "report"}`)
+	tests := []struct {
+		fileName string
+		data     []byte
+		want     string
+	}{
+		// Detected types other than generic ones win over the extension.
+		{"report.txt", pdf, "application/pdf"},
+		{"photo.docx", png, "image/png"},
+		// Generic types are corrected by the extension, whatever its case.
+		{"report.docx", zip, docx},
+		{"REPORT.DOCX", zip, docx},
+		{"data.json", text, "application/json"},
+		// Without a known extension, the detected type is kept.
+		{"archive", zip, "application/zip"},
+		{"notes", text, "text/plain; charset=utf-8"},
+		{"data.unknownext", []byte{0, 1, 2}, "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := documentMimeType(tt.fileName, tt.data); got != tt.want {
+			t.Errorf("documentMimeType(%q) = %q, want %q", tt.fileName, got, tt.want)
+		}
+	}
+}
+
+func TestCountPDFPagesWithoutPdfinfo(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	data := []byte("1 0 obj << /Type /Pages /Count 3 >>\n2 0 obj << /Type /Page >>\n3 0 obj << /Type/Page/Parent 1 0 R >>\n4 0 obj << /Type /Page\n>>")
+	if pages := countPDFPages("", data); pages != 3 {
+		t.Errorf("countPDFPages() = %d, want 3", pages)
+	}
+}
+
+func TestPrepareDocumentTitle(t *testing.T) {
+	tests := []struct {
+		fileName string
+		want     string
+	}{
+		{"Quarterly report.docx", "Quarterly report"},
+		{"archive.tar.gz", "archive.tar"},
+		{".env", ".env"},
+		{"notes", "notes"},
+	}
+	for _, tt := range tests {
+		if got := prepareDocument(tt.fileName, []byte("text")).Title; got != tt.want {
+			t.Errorf("prepareDocument(%q).Title = %q, want %q", tt.fileName, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Media files and message content can be encrypted at rest with AES-256-GCM. Keys are read
+// from -encryption-key-file, one base64 encoded 32 byte key per line, or from the comma
+// separated $ENCRYPTION_KEYS. The first key encrypts new data and the others are only used to
+// decrypt data encrypted before a key rotation. Every ciphertext records the ID of its key,
+// so unencrypted data written before encryption was enabled is still read as-is.
+//
+// Encrypted media files are streamMagic, the key ID and a nonce prefix, followed by the file
+// sealed in segments (see encryptionstream.go).
+// Encrypted content is the base64 encoded nonce and sealed content. The hex ID of its key is
+// stored in the content_key column next to it, which is empty for plaintext, so that no message
+// text can be mistaken for ciphertext.
+
+const (
+	keyIDSize = 4
+)
+
+type encryptionKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+var encryptionKeys []encryptionKey // Current key first, then older keys
+
+// Load the encryption keys. Encryption is disabled if no keys are configured.
+func loadEncryptionKeys() error {
+	var encodedKeys []string
+	if *encryptionKeyFile != "" {
+		file, err := os.Open(*encryptionKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to open key file: %w", err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				encodedKeys = append(encodedKeys, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read key file: %w", err)
+		}
+	} else {
+		encodedKeys = splitList(os.Getenv("ENCRYPTION_KEYS"))
+	}
+
+	keys := make([]encryptionKey, 0, len(encodedKeys))
+	for i, encoded := range encodedKeys {
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("invalid encryption key %d: %w", i+1, err)
+		} else if len(raw) != 32 {
+			return fmt.Errorf("invalid encryption key %d: expected 32 bytes, got %d", i+1, len(raw))
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(raw)
+		keys = append(keys, encryptionKey{id: sum[:keyIDSize], aead: aead})
+	}
+	encryptionKeys = keys
+	if len(keys) > 0 {
+		log.Infof("Encryption at rest enabled with key %x (%d keys loaded)", keys[0].id, len(keys))
+	}
+	return nil
+}
+
+func encryptionEnabled() bool {
+	return len(encryptionKeys) > 0
+}
+
+func findEncryptionKey(id []byte) (*encryptionKey, error) {
+	for i := range encryptionKeys {
+		if bytes.Equal(encryptionKeys[i].id, id) {
+			return &encryptionKeys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown encryption key %x", id)
+}
+
+// Seal data with the current key, returning the nonce followed by the ciphertext.
+func seal(data, additionalData []byte) []byte {
+	key := encryptionKeys[0]
+	nonce := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(data)+key.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Errorf("failed to generate nonce: %w", err))
+	}
+	return key.aead.Seal(nonce, nonce, data, additionalData)
+}
+
+// Open data sealed with the given key.
+func unseal(keyID, sealed, additionalData []byte) ([]byte, error) {
+	key, err := findEncryptionKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < key.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonceSize := key.aead.NonceSize()
+	return key.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData)
+}
+
+// Get the hex ID of the current key, which is stored with content encrypted with it.
+func currentContentKey() string {
+	return hex.EncodeToString(encryptionKeys[0].id)
+}
+
+// Encrypt message content with the current key, if encryption is enabled. It returns the
+// content to store and the hex ID of its key, which is empty for content stored as-is. Empty
+// content is stored as-is.
+func encryptContent(content string) (string, string) {
+	if !encryptionEnabled() || content == "" {
+		return content, ""
+	}
+	keyID := currentContentKey()
+	return base64.StdEncoding.EncodeToString(seal([]byte(content), []byte(keyID))), keyID
+}
+
+// Decrypt message content stored with the hex ID of its key. Content without a key is
+// plaintext and returned unchanged, as is content that isn't ciphertext at all.
+func decryptContent(content, keyIDHex string) (string, error) {
+	if keyIDHex == "" {
+		return content, nil
+	}
+	keyID, err := hex.DecodeString(keyIDHex)
+	if err != nil || len(keyID) != keyIDSize {
+		log.Warnf("Invalid content key %q, reading content as plaintext", keyIDHex)
+		return content, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		log.Warnf("Content encrypted with key %s isn't ciphertext, reading it as plaintext", keyIDHex)
+		return content, nil
+	}
+	plaintext, err := unseal(keyID, sealed, []byte(keyIDHex))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt content: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// EncryptedMediaStore encrypts files written to another media store and transparently
+// decrypts them when they are read. Files are encrypted and decrypted in segments as they are
+// streamed. Stat and Delete are passed through, so Stat reports the encrypted size.
+type encryptedMediaStore struct {
+	MediaStore
+}
+
+func (s *encryptedMediaStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	encryptedSize := int64(-1)
+	if size >= 0 {
+		encryptedSize = encryptedStreamSize(size, encryptionKeys[0].aead.Overhead())
+	}
+	return s.MediaStore.Put(ctx, key, newStreamEncrypter(r), encryptedSize, contentType)
+}
+
+// Open a file for reading its plaintext. It also returns the ID of the key the file is encrypted
+// with, or nil if it isn't encrypted and has to be encrypted by a key rotation.
+func (s *encryptedMediaStore) open(ctx context.Context, key string) (MediaObject, MediaInfo, []byte, error) {
+	obj, info, err := s.MediaStore.Open(ctx, key)
+	if err != nil {
+		return nil, info, nil, err
+	}
+	header := make([]byte, streamHeaderSize)
+	n, err := io.ReadFull(obj, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		obj.Close()
+		return nil, info, nil, err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte(streamMagic)):
+		decrypter, err := newStreamDecrypter(obj, header, info.Size)
+		if err != nil {
+			obj.Close()
+			return nil, info, nil, fmt.Errorf("failed to decrypt %s: %w", key, err)
+		}
+		info.Size = decrypter.size
+		return decrypter, info, header[len(streamMagic) : len(streamMagic)+keyIDSize], nil
+	default:
+		if _, err := obj.Seek(0, io.SeekStart); err != nil {
+			obj.Close()
+			return nil, info, nil, err
+		}
+		return obj, info, nil, nil
+	}
+}
+
+func (s *encryptedMediaStore) Open(ctx context.Context, key string) (MediaObject, MediaInfo, error) {
+	obj, info, _, err := s.open(ctx, key)
+	return obj, info, err
+}
+
+// Re-encrypt a file with the current key unless it already is, reporting whether it was rewritten.
+func (s *encryptedMediaStore) reencrypt(ctx context.Context, key string) (bool, error) {
+	obj, info, keyID, err := s.open(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer obj.Close()
+	if bytes.Equal(keyID, encryptionKeys[0].id) {
+		return false, nil
+	}
+	return true, s.Put(ctx, key, obj, info.Size, info.ContentType)
+}
+
+// Re-encrypt stored message content and media files with the current key after a key rotation.
+// Data that was stored before encryption was enabled is encrypted as well.
+func handleRotateKeys() {
+	store, ok := mediaStore.(*encryptedMediaStore)
+	if !ok {
+		sendReply("rotatekeys", nil, fmt.Errorf("encryption is not enabled"))
+		return
+	}
+
+	messages, err := reencryptContent()
+	if err != nil {
+		log.Errorf("Failed to re-encrypt message content: %v", err)
+		sendReply("rotatekeys", nil, err)
+		return
+	}
+
+	keys, err := listMediaKeys()
+	if err != nil {
+		log.Errorf("Failed to list media files: %v", err)
+		sendReply("rotatekeys", nil, err)
+		return
+	}
+	files := 0
+	for _, key := range keys {
+		rewritten, err := store.reencrypt(context.Background(), key)
+		if errors.Is(err, ErrMediaNotFound) {
+			continue
+		} else if err != nil {
+			log.Errorf("Failed to re-encrypt %s: %v", key, err)
+			continue
+		}
+		if rewritten {
+			files++
+		}
+	}
+
+	log.Infof("Re-encrypted %d messages and %d media files with key %x", messages, files, encryptionKeys[0].id)
+	sendReply("rotatekeys", map[string]interface{}{"messages": messages, "files": files, "key_id": hex.EncodeToString(encryptionKeys[0].id)}, nil)
+}
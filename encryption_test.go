@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Load random encryption keys for a test, the first one being the current key.
+func useTestKeys(t *testing.T, keys ...[]byte) {
+	t.Helper()
+	encoded := make([]string, len(keys))
+	for i, key := range keys {
+		encoded[i] = base64.StdEncoding.EncodeToString(key)
+	}
+	t.Setenv("ENCRYPTION_KEYS", strings.Join(encoded, ","))
+	previous := encryptionKeys
+	t.Cleanup(func() { encryptionKeys = previous })
+	if err := loadEncryptionKeys(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncryptContent(t *testing.T) {
+	oldKey, newKey := randomBytes(t, 32), randomBytes(t, 32)
+	useTestKeys(t, oldKey)
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "empty", content: ""},
+		{name: "text", content: "hello"},
+		{name: "unicode", content: "Merhaba dünya 👋"},
+		{name: "ciphertext lookalike", content: "enc:00000000:AA=="},
+	}
+	for _, tt := range tests {
+		encrypted, keyID := encryptContent(tt.content)
+		if tt.content != "" && (encrypted == tt.content || keyID != currentContentKey()) {
+			t.Errorf("%s: encryptContent() = %q, %q, want content encrypted with the current key", tt.name, encrypted, keyID)
+		}
+		if decrypted, err := decryptContent(encrypted, keyID); err != nil || decrypted != tt.content {
+			t.Errorf("%s: decryptContent() = %q, %v, want %q", tt.name, decrypted, err, tt.content)
+		}
+	}
+
+	// Content without a key, or that isn't ciphertext, is read as plaintext whatever it contains.
+	for _, plaintext := range []string{"hello", "enc:00000000:AA==", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"} {
+		if decrypted, err := decryptContent(plaintext, ""); err != nil || decrypted != plaintext {
+			t.Errorf("decryptContent(%q) without a key = %q, %v, want it unchanged", plaintext, decrypted, err)
+		}
+	}
+	if decrypted, err := decryptContent("not base64!", currentContentKey()); err != nil || decrypted != "not base64!" {
+		t.Errorf("decryptContent() of plaintext with a key = %q, %v, want it unchanged", decrypted, err)
+	}
+
+	encrypted, keyID := encryptContent("hello")
+	tampered := encrypted[:len(encrypted)-4] + "AAA="
+	if _, err := decryptContent(tampered, keyID); err == nil {
+		t.Errorf("decryptContent() of tampered content succeeded")
+	}
+
+	// After a rotation, content encrypted with the old key is still readable.
+	useTestKeys(t, newKey, oldKey)
+	if decrypted, err := decryptContent(encrypted, keyID); err != nil || decrypted != "hello" {
+		t.Errorf("decryptContent() with the old key = %q, %v, want %q", decrypted, err, "hello")
+	}
+	useTestKeys(t, newKey)
+	if _, err := decryptContent(encrypted, keyID); err == nil {
+		t.Errorf("decryptContent() without the key succeeded")
+	}
+}
+
+func TestEncryptedMediaStore(t *testing.T) {
+	useTestKeys(t, randomBytes(t, 32))
+	local, err := newLocalMediaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &encryptedMediaStore{local}
+	ctx := context.Background()
+
+	sizes := []int{0, 1, streamSegmentSize - 1, streamSegmentSize, streamSegmentSize + 1, 3*streamSegmentSize + 5}
+	for _, size := range sizes {
+		data := randomBytes(t, size)
+		if err := store.Put(ctx, "file", bytes.NewReader(data), int64(size), "application/octet-stream"); err != nil {
+			t.Fatalf("size %d: Put() error = %v", size, err)
+		}
+		raw, err := readAll(local, "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := encryptedStreamSize(int64(size), encryptionKeys[0].aead.Overhead()); int64(len(raw)) != want {
+			t.Errorf("size %d: encrypted to %d bytes, want %d", size, len(raw), want)
+		}
+		// Short plaintexts may occur in the ciphertext by chance.
+		if size >= 16 && bytes.Contains(raw, data) {
+			t.Errorf("size %d: stored file contains the plaintext", size)
+		}
+
+		obj, info, err := store.Open(ctx, "file")
+		if err != nil {
+			t.Fatalf("size %d: Open() error = %v", size, err)
+		}
+		if info.Size != int64(size) {
+			t.Errorf("size %d: Open() reports size %d", size, info.Size)
+		}
+		if got, err := io.ReadAll(obj); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %d: read %d bytes, %v, want the original file", size, len(got), err)
+		}
+		if size > streamSegmentSize+13 {
+			offset := int64(streamSegmentSize + 3)
+			if _, err := obj.Seek(offset, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 10)
+			if _, err := io.ReadFull(obj, got); err != nil || !bytes.Equal(got, data[offset:offset+10]) {
+				t.Errorf("size %d: read %x, %v at offset %d, want %x", size, got, err, offset, data[offset:offset+10])
+			}
+		}
+		obj.Close()
+	}
+}
+
+func TestEncryptedMediaStoreRejectsTamperedFiles(t *testing.T) {
+	useTestKeys(t, randomBytes(t, 32))
+	local, err := newLocalMediaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &encryptedMediaStore{local}
+	ctx := context.Background()
+	data := randomBytes(t, 2*streamSegmentSize+100)
+	if err := store.Put(ctx, "file", bytes.NewReader(data), int64(len(data)), ""); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := readAll(local, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := streamSegmentSize + encryptionKeys[0].aead.Overhead()
+
+	flipped := append([]byte(nil), raw...)
+	flipped[streamHeaderSize+segment+10] ^= 1
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{name: "modified segment", raw: flipped},
+		{name: "truncated at a segment boundary", raw: raw[:streamHeaderSize+2*segment]},
+		{name: "truncated in a segment", raw: raw[:len(raw)-5]},
+		{name: "reordered segments", raw: append(append(append([]byte(nil), raw[:streamHeaderSize]...), raw[streamHeaderSize+segment:streamHeaderSize+2*segment]...),
+			append(raw[streamHeaderSize:streamHeaderSize+segment], raw[streamHeaderSize+2*segment:]...)...)},
+	}
+	for _, tt := range tests {
+		if err := local.Put(ctx, "tampered", bytes.NewReader(tt.raw), int64(len(tt.raw)), ""); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := readAll(store, "tampered"); err == nil {
+			t.Errorf("%s: read %d bytes without an error", tt.name, len(got))
+		}
+	}
+}
+
+func TestEncryptedMediaStoreReadsUnencryptedFiles(t *testing.T) {
+	useTestKeys(t, randomBytes(t, 32))
+	local, err := newLocalMediaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &encryptedMediaStore{local}
+	ctx := context.Background()
+	data := randomBytes(t, 1000)
+
+	// Files stored before encryption was enabled are read as-is, and encrypted by a key rotation.
+	if err := local.Put(ctx, "file", bytes.NewReader(data), int64(len(data)), ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readAll(store, "file"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, %v, want the original file", len(got), err)
+	}
+	if rewritten, err := store.reencrypt(ctx, "file"); err != nil || !rewritten {
+		t.Errorf("reencrypt() = %v, %v, want the file rewritten", rewritten, err)
+	}
+	if got, err := readAll(store, "file"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, %v after reencrypt, want the original file", len(got), err)
+	}
+	if rewritten, err := store.reencrypt(ctx, "file"); err != nil || rewritten {
+		t.Errorf("second reencrypt() = %v, %v, want the file left as is", rewritten, err)
+	}
+}
+
+func readAll(store MediaStore, key string) ([]byte, error) {
+	obj, _, err := store.Open(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
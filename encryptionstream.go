@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Media files are encrypted in segments of streamSegmentSize bytes, like the STREAM
+// construction: each segment is sealed with a nonce made of a random prefix, its index and
+// whether it is the last one, so that segments can't be reordered or dropped. Files are
+// encrypted and decrypted as they are streamed, and can be read from any offset.
+
+const (
+	streamMagic       = "WAENC\x02"
+	streamPrefixSize  = 7         // Random nonce prefix, followed by the segment index and the last segment flag
+	streamSegmentSize = 64 * 1024 // Plaintext size of all but the last segment
+	streamHeaderSize  = len(streamMagic) + keyIDSize + streamPrefixSize
+)
+
+// Get the nonce of a segment.
+func streamNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 0, streamPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// Get the size of a file once it is encrypted with an AEAD with the given overhead.
+func encryptedStreamSize(size int64, overhead int) int64 {
+	segments := (size + streamSegmentSize - 1) / streamSegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return int64(streamHeaderSize) + size + segments*int64(overhead)
+}
+
+// Get the plaintext size and number of segments of an encrypted file.
+func decryptedStreamSize(size int64, overhead int) (int64, int64, error) {
+	body := size - int64(streamHeaderSize)
+	segment := int64(streamSegmentSize + overhead)
+	segments := (body + segment - 1) / segment
+	if body < int64(overhead) || body-(segments-1)*segment < int64(overhead) {
+		return 0, 0, errors.New("encrypted file is truncated")
+	}
+	return body - segments*int64(overhead), segments, nil
+}
+
+// StreamEncrypter reads a file and returns it encrypted with the current key.
+type streamEncrypter struct {
+	src    *bufio.Reader
+	key    encryptionKey
+	header []byte
+	index  uint32
+	plain  []byte
+	sealed []byte
+	out    []byte // Encrypted data that wasn't read yet
+	done   bool
+}
+
+func newStreamEncrypter(r io.Reader) *streamEncrypter {
+	key := encryptionKeys[0]
+	header := make([]byte, streamHeaderSize)
+	copy(header, streamMagic)
+	copy(header[len(streamMagic):], key.id)
+	if _, err := rand.Read(header[len(streamMagic)+keyIDSize:]); err != nil {
+		panic(fmt.Errorf("failed to generate nonce: %w", err))
+	}
+	return &streamEncrypter{
+		src:    bufio.NewReader(r),
+		key:    key,
+		header: header,
+		plain:  make([]byte, streamSegmentSize),
+		sealed: make([]byte, 0, streamSegmentSize+key.aead.Overhead()),
+		out:    append([]byte(nil), header...),
+	}
+}
+
+func (e *streamEncrypter) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// Read and seal the next segment of the file.
+func (e *streamEncrypter) sealNext() error {
+	n, err := io.ReadFull(e.src, e.plain)
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+	if !last {
+		if _, err := e.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if !last && e.index == math.MaxUint32 {
+		return errors.New("file is too large to encrypt")
+	}
+	nonce := streamNonce(e.header[len(streamMagic)+keyIDSize:], e.index, last)
+	e.out = e.key.aead.Seal(e.sealed[:0], nonce, e.plain[:n], e.header)
+	e.index++
+	e.done = last
+	return nil
+}
+
+// StreamDecrypter decrypts an encrypted file as it is read. Segments are decrypted one at a
+// time, so it can seek to any offset of the file.
+type streamDecrypter struct {
+	src      MediaObject
+	srcPos   int64
+	key      *encryptionKey
+	header   []byte
+	size     int64 // Plaintext size
+	segments int64
+	offset   int64
+	index    int64 // Index of the segment in plain, or -1
+	sealed   []byte
+	plain    []byte
+}
+
+// Create a decrypter of an encrypted file whose header was read from src.
+func newStreamDecrypter(src MediaObject, header []byte, encryptedSize int64) (*streamDecrypter, error) {
+	if len(header) < streamHeaderSize {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	key, err := findEncryptionKey(header[len(streamMagic) : len(streamMagic)+keyIDSize])
+	if err != nil {
+		return nil, err
+	}
+	size, segments, err := decryptedStreamSize(encryptedSize, key.aead.Overhead())
+	if err != nil {
+		return nil, err
+	}
+	return &streamDecrypter{
+		src:      src,
+		srcPos:   int64(streamHeaderSize),
+		key:      key,
+		header:   header,
+		size:     size,
+		segments: segments,
+		index:    -1,
+		sealed:   make([]byte, streamSegmentSize+key.aead.Overhead()),
+		plain:    make([]byte, 0, streamSegmentSize),
+	}, nil
+}
+
+func (d *streamDecrypter) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+	index := d.offset / streamSegmentSize
+	if index != d.index {
+		if err := d.openSegment(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.offset-index*streamSegmentSize:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+// Read and open a segment of the file.
+func (d *streamDecrypter) openSegment(index int64) error {
+	overhead := int64(d.key.aead.Overhead())
+	start := int64(streamHeaderSize) + index*(streamSegmentSize+overhead)
+	if start != d.srcPos {
+		if _, err := d.src.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		d.srcPos = start
+	}
+	last := index == d.segments-1
+	sealed := d.sealed
+	if last {
+		sealed = sealed[:d.size-index*streamSegmentSize+overhead]
+	}
+	n, err := io.ReadFull(d.src, sealed)
+	d.srcPos += int64(n)
+	if err != nil {
+		return err
+	}
+	d.index = -1
+	nonce := streamNonce(d.header[len(streamMagic)+keyIDSize:], uint32(index), last)
+	if d.plain, err = d.key.aead.Open(d.plain[:0], nonce, sealed, d.header); err != nil {
+		return fmt.Errorf("failed to decrypt segment %d: %w", index, err)
+	}
+	d.index = index
+	return nil
+}
+
+func (d *streamDecrypter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *streamDecrypter) Close() error {
+	return d.src.Close()
+}
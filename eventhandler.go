@@ -3,17 +3,21 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"mime"
 	"os"
 	"strings"
 	"sync/atomic"
+	"time"
 
+	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/appstate"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
 )
 
 func handleAppStateSyncComplete(evt *events.AppStateSyncComplete) {
+	if evt.Name == appstate.WAPatchCriticalUnblockLow {
+		go syncContacts()
+	}
 	if len(cli.Store.PushName) > 0 && evt.Name == appstate.WAPatchCriticalBlock {
 		err := cli.SendPresence(types.PresenceAvailable)
 		if err != nil {
@@ -25,6 +29,10 @@ func handleAppStateSyncComplete(evt *events.AppStateSyncComplete) {
 }
 
 func handleConnectedOrPushNameSetting(evt interface{}) {
+	if _, ok := evt.(*events.Connected); ok {
+		go syncContacts()
+		go refreshBlocklist()
+	}
 	if len(cli.Store.PushName) == 0 {
 		return
 	}
@@ -66,12 +74,16 @@ func handleMessage(evt *events.Message) {
 		metaParts = append(metaParts, "edit")
 	}
 
-	log.Infof("Received message %s from %s (%s): %+v", evt.Info.ID, evt.Info.SourceString(), strings.Join(metaParts, ", "), evt.Message)
+	log.Infof("Received message %s from %s (%s)", evt.Info.ID, evt.Info.SourceString(), strings.Join(metaParts, ", "))
 
 	if evt.Message.GetProtocolMessage() != nil {
 		return
 	}
 
+	if evt.Info.Chat == types.StatusBroadcastJID && !*ingestStatus {
+		return
+	}
+
 	if evt.Message.GetPollUpdateMessage() != nil {
 		decrypted, err := cli.DecryptPollVote(evt)
 		if err != nil {
@@ -87,76 +99,39 @@ func handleMessage(evt *events.Message) {
 		if err != nil {
 			log.Errorf("Failed to decrypt encrypted reaction: %v", err)
 		} else {
-			log.Infof("Decrypted reaction: %+v", decrypted)
+			log.Infof("Decrypted reaction to %s", decrypted.GetKey().GetId())
 		}
 	}
 
-	var extension string
 	var fileName string
+	var media *Media
+	var err error
 
 	if img := evt.Message.GetImageMessage(); img != nil {
-		data, err := cli.Download(img)
-		if err != nil {
-			log.Errorf("Failed to download image: %v", err)
-			return
-		}
-		exts, _ := mime.ExtensionsByType(img.GetMimetype())
-		extension = exts[0]
-		path := fmt.Sprintf("%s%s", evt.Info.ID, extension)
-		_ = os.WriteFile(path, data, 0644)
-
-		path = fmt.Sprintf("%s%s", evt.Info.ID, ".jpg")
-		err = os.WriteFile(path, img.GetJpegThumbnail(), 0644)
-
-		if err != nil {
+		if media, err = storeIncomingMedia(img, evt.Info, img.GetMimetype(), "", img.GetJpegThumbnail()); err != nil {
 			log.Errorf("Failed to save image: %v", err)
-			return
 		}
-		log.Infof("Saved image message to %s", path)
 	}
 	if doc := evt.Message.GetDocumentMessage(); doc != nil {
-		data, err := cli.Download(doc)
-		if err != nil {
-			log.Errorf("Failed to download document: %v", err)
-			return
-		}
-		exts, _ := mime.ExtensionsByType(doc.GetMimetype())
-		extension = exts[0]
-		path := fmt.Sprintf("%s%s", evt.Info.ID, extension)
-		err = os.WriteFile(path, data, 0644)
-		if err != nil {
+		if media, err = storeIncomingMedia(doc, evt.Info, doc.GetMimetype(), doc.GetFileName(), doc.GetJpegThumbnail()); err != nil {
 			log.Errorf("Failed to save document: %v", err)
-			return
 		}
-
 		fileName = doc.GetFileName()
-
-		path = fmt.Sprintf("%s%s", evt.Info.ID, ".jpg")
-		err = os.WriteFile(path, doc.GetJpegThumbnail(), 0644)
-
-		if err != nil {
-			log.Errorf("Failed to save document: %v", err)
-			return
-		}
-		log.Infof("Saved document message to %s", path)
 	}
-
 	if audio := evt.Message.GetAudioMessage(); audio != nil {
-		data, err := cli.Download(audio)
-		if err != nil {
-			log.Errorf("Failed to download audio: %v", err)
-			return
-		}
-		exts, _ := mime.ExtensionsByType(audio.GetMimetype())
-		extension = exts[0]
-		path := fmt.Sprintf("%s%s", evt.Info.ID, extension)
-		err = os.WriteFile(path, data, 0644)
-		if err != nil {
+		if media, err = storeIncomingMedia(audio, evt.Info, audio.GetMimetype(), "", nil); err != nil {
 			log.Errorf("Failed to save audio: %v", err)
-			return
 		}
-
-		log.Infof("Saved audio message to %s", path)
+	}
+	if video := evt.Message.GetVideoMessage(); video != nil {
+		if media, err = storeIncomingMedia(video, evt.Info, video.GetMimetype(), "", video.GetJpegThumbnail()); err != nil {
+			log.Errorf("Failed to save video: %v", err)
+		}
+	}
+	if sticker := evt.Message.GetStickerMessage(); sticker != nil {
+		if media, err = storeIncomingMedia(sticker, evt.Info, sticker.GetMimetype(), "", sticker.GetPngThumbnail()); err != nil {
+			log.Errorf("Failed to save sticker: %v", err)
+		}
 	}
 
 	var msgContent string
@@ -178,9 +153,15 @@ func handleMessage(evt *events.Message) {
 	case evt.Message.GetVideoMessage() != nil:
 		msgContent = evt.Message.GetVideoMessage().GetCaption()
 		msgType = "media"
+	case evt.Message.GetStickerMessage() != nil:
+		msgType = "media"
+	case evt.Message.GetGroupInviteMessage() != nil:
+		msgContent = evt.Message.GetGroupInviteMessage().GetCaption()
+		msgType = "invite"
 	}
 
 	remoteJid := evt.Info.MessageSource.Chat.String()
+	senderJid := evt.Info.MessageSource.Sender.ToNonAD().String()
 
 	if evt.Info.Category == "peer" {
 		// Bunlar ilk login olunduğunda alınan sistem mesajları, veritabanına yazmayalım.
@@ -188,24 +169,117 @@ func handleMessage(evt *events.Message) {
 		return
 	}
 
-	if remoteJid == "status@broadcast" {
+	if evt.Info.Chat == types.StatusBroadcastJID {
+		expiresAt := evt.Info.Timestamp.Add(statusLifetime)
+		if err := insertStatus(evt.Info.ID, senderJid, evt.Info.PushName, msgContent, msgType, evt.Info.Timestamp, expiresAt, fileName); err != nil {
+			log.Errorf("Error inserting into statuses: %v", err)
+		}
 		return
 	}
 
-	if err := insertMessages(evt.Info.ID, cli.Store.ID.String(), remoteJid, msgContent, msgType, evt.Info.Timestamp, evt.Info.MessageSource.IsFromMe, fileName, -1); err != nil {
+	if inv := evt.Message.GetGroupInviteMessage(); inv != nil {
+		invite := GroupInvite{
+			MessageID:  evt.Info.ID,
+			RemoteJID:  remoteJid,
+			GroupJID:   inv.GetGroupJid(),
+			GroupName:  inv.GetGroupName(),
+			InviterJID: evt.Info.Sender.ToNonAD().String(),
+			Code:       inv.GetInviteCode(),
+			Expiration: inv.GetInviteExpiration(),
+		}
+		if err := insertGroupInvite(invite); err != nil {
+			log.Errorf("Error inserting into group_invites: %v", err)
+		}
+		writeWS(invite)
+	}
+
+	if err := insertMessages(evt.Info.ID, cli.Store.ID.String(), remoteJid, senderJid, evt.Info.PushName, msgContent, msgType, evt.Info.Timestamp, evt.Info.MessageSource.IsFromMe, fileName, -1); err != nil {
 		log.Errorf("Error inserting into messages: %v", err)
 	}
 
-	if err := insertLastMessages(evt.Info.ID, cli.Store.ID.String(), remoteJid, msgContent, msgType, evt.Info.Timestamp, evt.Info.MessageSource.IsFromMe, fileName, -1); err != nil {
+	if media != nil && media.Status == MediaQuarantined {
+		flagQuarantinedMessage(media)
+	}
+
+	if err := insertLastMessages(evt.Info.ID, cli.Store.ID.String(), remoteJid, senderJid, evt.Info.PushName, msgContent, msgType, evt.Info.Timestamp, evt.Info.MessageSource.IsFromMe, fileName, -1); err != nil {
 		log.Errorf("Error inserting into last_messages: %v", err)
 	}
 
-	if wsConn != nil {
-		m := Message{evt.Info.ID, remoteJid, msgType, msgContent, evt.Info.MessageSource.IsFromMe, fileName}
-		wsConn.WriteJSON(m)
+	writeWS(Message{evt.Info.ID, remoteJid, msgType, msgContent, evt.Info.MessageSource.IsFromMe, fileName, senderJid, evt.Info.PushName})
+}
+
+// Periodically delete ingested status updates that have expired.
+func purgeExpiredStatusesLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := purgeExpiredStatuses(time.Now()); err != nil {
+			log.Errorf("Error purging expired statuses: %v", err)
+		}
+		<-ticker.C
 	}
 }
 
+// Store the media of an incoming message along with its embedded thumbnail, if any. The file
+// is downloaded right away unless the download is deferred by the -media-download policy. The
+// hash in the message is only used to verify the download, and the file is stored once per
+// content by the hash of the downloaded file. The media is recorded even if the download fails,
+// and the download is retried later. Files rejected by the malware scan are quarantined, and
+// files that couldn't be scanned are scanned again later.
+func storeIncomingMedia(msg whatsmeow.DownloadableMessage, info types.MessageInfo, mimeType, fileName string, thumbnail []byte) (*Media, error) {
+	media := Media{
+		MessageID:     info.ID,
+		RemoteJID:     info.Chat.String(),
+		MimeType:      mimeType,
+		FileName:      fileName,
+		CreatedAt:     info.Timestamp,
+		Status:        MediaPending,
+		SenderJID:     info.Sender.ToNonAD().String(),
+		FromMe:        info.IsFromMe,
+		MediaType:     mediaKind(msg),
+		DirectPath:    msg.GetDirectPath(),
+		MediaKey:      msg.GetMediaKey(),
+		FileEncSHA256: msg.GetFileEncSha256(),
+		FileSHA256:    msg.GetFileSha256(),
+	}
+	if sized, ok := msg.(interface{ GetFileLength() uint64 }); ok {
+		media.Size = int64(sized.GetFileLength())
+	}
+
+	var data []byte
+	var blob *MediaBlob
+	var downloadErr error
+	if shouldDownloadEagerly(info.Chat, media.MediaType, media.Size) {
+		if data, downloadErr = cli.Download(msg); downloadErr != nil {
+			downloadErr = fmt.Errorf("failed to download: %w", downloadErr)
+		} else if clean, scanErr := scanMedia(&media, data); scanErr != nil {
+			data, downloadErr = nil, scanErr
+		} else if clean {
+			blob, downloadErr = storeBlob(data, mimeType)
+		} else {
+			data = nil
+		}
+	}
+	if blob != nil {
+		media.StorageKey, media.SHA256, media.Size, media.Status = blob.StorageKey, blob.SHA256, blob.Size, MediaAvailable
+	}
+	storeThumbnail(&media, data, thumbnail)
+
+	if err := upsertMedia(media); err != nil {
+		return nil, fmt.Errorf("failed to insert into media: %w", err)
+	}
+	if downloadErr != nil {
+		requestMediaRetry(&media, downloadErr)
+		return &media, downloadErr
+	}
+	if media.StorageKey == "" {
+		log.Infof("Deferred download of media of %s", info.ID)
+	} else {
+		log.Infof("Saved media of %s to %s", info.ID, media.StorageKey)
+	}
+	return &media, nil
+}
+
 func handleReceipt(evt *events.Receipt) {
 	if evt.Type == events.ReceiptTypeRead || evt.Type == events.ReceiptTypeReadSelf {
 		log.Infof("%v was read by %s at %s", evt.MessageIDs, evt.SourceString(), evt.Timestamp)
@@ -256,3 +330,94 @@ func handleKeepAliveTimeout(evt *events.KeepAliveTimeout) {
 func handleKeepAliveRestored(evt *events.KeepAliveRestored) {
 	log.Debugf("Keepalive restored")
 }
+
+// GroupEvent is the content of a system entry recorded in a group's conversation timeline.
+type GroupEvent struct {
+	Action      string `json:"action"`
+	Participant string `json:"participant,omitempty"`
+	Actor       string `json:"actor,omitempty"`
+	Value       string `json:"value,omitempty"`
+}
+
+func handleJoinedGroup(evt *events.JoinedGroup) {
+	log.Infof("Joined group %s (%s), reason: %q", evt.JID, evt.Name, evt.Reason)
+	storeGroupInfo(&evt.GroupInfo)
+	// The event carries the group's creation date but not when it was joined, which is now.
+	recordGroupEvent(evt.JID, time.Now(), GroupEvent{Action: "joined", Value: evt.Reason})
+}
+
+func handleGroupInfo(evt *events.GroupInfo) {
+	groupJID := evt.JID.String()
+	var actor string
+	if evt.Sender != nil {
+		actor = evt.Sender.String()
+	}
+
+	if evt.Name != nil {
+		if err := updateGroupName(groupJID, evt.Name.Name); err != nil {
+			log.Errorf("Error updating group name: %v", err)
+		}
+		recordGroupEvent(evt.JID, evt.Timestamp, GroupEvent{Action: "subject", Actor: actor, Value: evt.Name.Name})
+	}
+	if evt.Topic != nil {
+		if err := updateGroupTopic(groupJID, evt.Topic.Topic); err != nil {
+			log.Errorf("Error updating group topic: %v", err)
+		}
+		recordGroupEvent(evt.JID, evt.Timestamp, GroupEvent{Action: "description", Actor: actor, Value: evt.Topic.Topic})
+	}
+
+	for _, jid := range evt.Join {
+		if err := upsertGroupParticipant(groupJID, jid.String(), false); err != nil {
+			log.Errorf("Error adding group participant: %v", err)
+		}
+		recordGroupEvent(evt.JID, evt.Timestamp, GroupEvent{Action: "join", Participant: jid.String(), Actor: actor, Value: evt.JoinReason})
+	}
+	for _, jid := range evt.Leave {
+		if err := deleteGroupParticipant(groupJID, jid.String()); err != nil {
+			log.Errorf("Error removing group participant: %v", err)
+		}
+		recordGroupEvent(evt.JID, evt.Timestamp, GroupEvent{Action: "leave", Participant: jid.String(), Actor: actor})
+	}
+	for _, jid := range evt.Promote {
+		if err := upsertGroupParticipant(groupJID, jid.String(), true); err != nil {
+			log.Errorf("Error promoting group participant: %v", err)
+		}
+		recordGroupEvent(evt.JID, evt.Timestamp, GroupEvent{Action: "promote", Participant: jid.String(), Actor: actor})
+	}
+	for _, jid := range evt.Demote {
+		if err := upsertGroupParticipant(groupJID, jid.String(), false); err != nil {
+			log.Errorf("Error demoting group participant: %v", err)
+		}
+		recordGroupEvent(evt.JID, evt.Timestamp, GroupEvent{Action: "demote", Participant: jid.String(), Actor: actor})
+	}
+}
+
+// Persist the metadata and participants of a group.
+func storeGroupInfo(info *types.GroupInfo) {
+	if err := upsertGroup(info); err != nil {
+		log.Errorf("Error upserting group: %v", err)
+		return
+	}
+	if err := replaceGroupParticipants(info.JID.String(), info.Participants); err != nil {
+		log.Errorf("Error replacing group participants: %v", err)
+	}
+}
+
+// Record a group change as a system entry in the group's conversation and forward it to the client.
+func recordGroupEvent(group types.JID, timestamp time.Time, groupEvent GroupEvent) {
+	content, err := json.Marshal(groupEvent)
+	if err != nil {
+		log.Errorf("Failed to marshal group event: %v", err)
+		return
+	}
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	messageID := cli.GenerateMessageID()
+	if err := insertMessages(messageID, cli.Store.ID.String(), group.String(), groupEvent.Actor, "", string(content), "system", timestamp, false, "", -1); err != nil {
+		log.Errorf("Error inserting into messages: %v", err)
+	}
+
+	writeWS(Message{messageID, group.String(), "system", string(content), false, "", groupEvent.Actor, ""})
+}
@@ -9,7 +9,8 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/mdp/qrterminal/v3 v3.1.1
 	github.com/minio/minio-go/v7 v7.0.61
-	go.mau.fi/whatsmeow v0.0.0-20230816173759-58beaf3b5bd0
+	go.mau.fi/whatsmeow v0.0.0-20230916142552-a743fdc23bf1
+	golang.org/x/image v0.11.0
 	google.golang.org/protobuf v1.31.0
 )
 
@@ -27,12 +28,11 @@ require (
 	github.com/rs/xid v1.5.0 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	go.mau.fi/libsignal v0.1.0 // indirect
-	go.mau.fi/util v0.0.0-20230805171708-199bf3eec776 // indirect
-	golang.org/x/crypto v0.12.0 // indirect
-	golang.org/x/image v0.11.0 // indirect
+	go.mau.fi/util v0.1.0 // indirect
+	golang.org/x/crypto v0.13.0 // indirect
 	golang.org/x/net v0.14.0 // indirect
-	golang.org/x/sys v0.11.0 // indirect
-	golang.org/x/text v0.12.0 // indirect
+	golang.org/x/sys v0.12.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 	rsc.io/qr v0.2.0 // indirect
 )
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Parse a list of participant JIDs, stopping at the first invalid one.
+func parseJIDs(args []string) ([]types.JID, error) {
+	jids := make([]types.JID, 0, len(args))
+	for _, arg := range args {
+		jid, err := parseJID(arg)
+		if err != nil {
+			return nil, err
+		}
+		jids = append(jids, jid)
+	}
+	return jids, nil
+}
+
+// Parse a group JID. Bare group IDs without a server are assumed to be on g.us.
+func parseGroupJID(arg string) (types.JID, error) {
+	if arg != "" && !strings.ContainsRune(arg, '@') {
+		return types.NewJID(arg, types.GroupServer), nil
+	}
+	jid, err := parseJID(arg)
+	if err == nil && jid.Server != types.GroupServer {
+		log.Errorf("Invalid group JID %s: not a group", arg)
+		return jid, fmt.Errorf("invalid group JID %q: not a group", arg)
+	}
+	return jid, err
+}
+
+func handleCreateGroup(args []string) {
+	if len(args) < 2 {
+		log.Errorf("Usage: creategroup <name> <participants...>")
+		sendReply("creategroup", nil, fmt.Errorf("usage: creategroup <name> <participants...>"))
+		return
+	}
+
+	participants, err := parseJIDs(args[1:])
+	if err != nil {
+		sendReply("creategroup", nil, err)
+		return
+	}
+
+	info, err := cli.CreateGroup(whatsmeow.ReqCreateGroup{
+		Name:         args[0],
+		Participants: participants,
+	})
+	if err != nil {
+		log.Errorf("Failed to create group: %v", err)
+		sendReply("creategroup", nil, err)
+		return
+	}
+
+	log.Infof("Created group %s (%s)", info.JID, info.Name)
+	sendReply("creategroup", info, nil)
+}
+
+var participantChanges = map[string]whatsmeow.ParticipantChange{
+	"addparticipants":     whatsmeow.ParticipantChangeAdd,
+	"removeparticipants":  whatsmeow.ParticipantChangeRemove,
+	"promoteparticipants": whatsmeow.ParticipantChangePromote,
+	"demoteparticipants":  whatsmeow.ParticipantChangeDemote,
+}
+
+// ParticipantResult is the outcome of a participant change for one participant. Error is the
+// code WhatsApp rejected the change with, e.g. 403 if the user doesn't allow being added.
+type ParticipantResult struct {
+	JID   types.JID `json:"jid"`
+	Error int       `json:"error,omitempty"`
+}
+
+// Get the result of a participant change for each participant from the response to it.
+// Participants the response doesn't mention are assumed to be changed.
+func parseParticipantResults(resp *waBinary.Node, change whatsmeow.ParticipantChange, participants []types.JID) []ParticipantResult {
+	errorCodes := make(map[types.JID]int)
+	if resp != nil {
+		for _, action := range resp.GetChildrenByTag(string(change)) {
+			for _, child := range action.GetChildrenByTag("participant") {
+				ag := child.AttrGetter()
+				jid := ag.JID("jid")
+				if code := ag.OptionalInt("error"); ag.OK() && code != 0 {
+					errorCodes[jid.ToNonAD()] = code
+				}
+			}
+		}
+	}
+	results := make([]ParticipantResult, len(participants))
+	for i, participant := range participants {
+		results[i] = ParticipantResult{JID: participant, Error: errorCodes[participant.ToNonAD()]}
+	}
+	return results
+}
+
+func handleUpdateParticipants(cmd string, args []string) {
+	if len(args) < 2 {
+		log.Errorf("Usage: %s <group_jid> <participants...>", cmd)
+		sendReply(cmd, nil, fmt.Errorf("usage: %s <group_jid> <participants...>", cmd))
+		return
+	}
+
+	group, err := parseGroupJID(args[0])
+	if err != nil {
+		sendReply(cmd, nil, err)
+		return
+	}
+
+	participants, err := parseJIDs(args[1:])
+	if err != nil {
+		sendReply(cmd, nil, err)
+		return
+	}
+
+	change := participantChanges[cmd]
+	changes := make(map[types.JID]whatsmeow.ParticipantChange, len(participants))
+	for _, participant := range participants {
+		changes[participant] = change
+	}
+
+	resp, err := cli.UpdateGroupParticipants(group, changes)
+	if err != nil {
+		log.Errorf("Failed to %s participants in %s: %v", change, group, err)
+		sendReply(cmd, nil, err)
+		return
+	}
+
+	results := parseParticipantResults(resp, change, participants)
+	var failed []string
+	for _, result := range results {
+		if result.Error != 0 {
+			failed = append(failed, fmt.Sprintf("%s (error %d)", result.JID, result.Error))
+		}
+	}
+	reply := map[string]interface{}{"group": group, "participants": results}
+	if len(failed) > 0 {
+		log.Errorf("Failed to %s participants in %s: %s", change, group, strings.Join(failed, ", "))
+		sendReply(cmd, reply, fmt.Errorf("failed to %s %d of %d participants: %s", change, len(failed), len(results), strings.Join(failed, ", ")))
+		return
+	}
+
+	log.Infof("Participants %s in %s: %v", change, group, participants)
+	sendReply(cmd, reply, nil)
+}
+
+func handleSetGroupName(args []string) {
+	if len(args) < 2 {
+		log.Errorf("Usage: setgroupname <group_jid> <name>")
+		sendReply("setgroupname", nil, fmt.Errorf("usage: setgroupname <group_jid> <name>"))
+		return
+	}
+
+	group, err := parseGroupJID(args[0])
+	if err != nil {
+		sendReply("setgroupname", nil, err)
+		return
+	}
+
+	name := strings.Join(args[1:], " ")
+	if err := cli.SetGroupName(group, name); err != nil {
+		log.Errorf("Failed to set group name: %v", err)
+		sendReply("setgroupname", nil, err)
+		return
+	}
+
+	log.Infof("Set name of %s to %s", group, name)
+	sendReply("setgroupname", map[string]interface{}{"group": group, "name": name}, nil)
+}
+
+func handleSetGroupTopic(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: setgrouptopic <group_jid> [topic]")
+		sendReply("setgrouptopic", nil, fmt.Errorf("usage: setgrouptopic <group_jid> [topic]"))
+		return
+	}
+
+	group, err := parseGroupJID(args[0])
+	if err != nil {
+		sendReply("setgrouptopic", nil, err)
+		return
+	}
+
+	// An empty topic removes the group description.
+	topic := strings.Join(args[1:], " ")
+	if err := cli.SetGroupTopic(group, "", "", topic); err != nil {
+		log.Errorf("Failed to set group topic: %v", err)
+		sendReply("setgrouptopic", nil, err)
+		return
+	}
+
+	log.Infof("Set topic of %s to %s", group, topic)
+	sendReply("setgrouptopic", map[string]interface{}{"group": group, "topic": topic}, nil)
+}
+
+func handleSetGroupPhoto(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: setgroupphoto <group_jid> [base64 jpeg]")
+		sendReply("setgroupphoto", nil, fmt.Errorf("usage: setgroupphoto <group_jid> [base64 jpeg]"))
+		return
+	}
+
+	group, err := parseGroupJID(args[0])
+	if err != nil {
+		sendReply("setgroupphoto", nil, err)
+		return
+	}
+
+	// Without image data the current photo is removed.
+	var avatar []byte
+	if len(args) > 1 {
+		var err error
+		avatar, err = base64.StdEncoding.DecodeString(args[1])
+		if err != nil {
+			log.Errorf("Invalid photo data: %v", err)
+			sendReply("setgroupphoto", nil, fmt.Errorf("invalid photo data: %w", err))
+			return
+		}
+		if mimeType := http.DetectContentType(avatar); mimeType != "image/jpeg" {
+			log.Errorf("Invalid photo type: %s", mimeType)
+			sendReply("setgroupphoto", nil, fmt.Errorf("group photo must be a JPEG image, got %s", mimeType))
+			return
+		}
+	}
+
+	pictureID, err := cli.SetGroupPhoto(group, avatar)
+	if err != nil {
+		log.Errorf("Failed to set group photo: %v", err)
+		sendReply("setgroupphoto", nil, err)
+		return
+	}
+
+	log.Infof("Set photo of %s: %s", group, pictureID)
+	sendReply("setgroupphoto", map[string]interface{}{"group": group, "picture_id": pictureID}, nil)
+}
+
+func handleLeaveGroup(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: leavegroup <group_jid>")
+		sendReply("leavegroup", nil, fmt.Errorf("usage: leavegroup <group_jid>"))
+		return
+	}
+
+	group, err := parseGroupJID(args[0])
+	if err != nil {
+		sendReply("leavegroup", nil, err)
+		return
+	}
+
+	if err := cli.LeaveGroup(group); err != nil {
+		log.Errorf("Failed to leave group: %v", err)
+		sendReply("leavegroup", nil, err)
+		return
+	}
+
+	log.Infof("Left group %s", group)
+	sendReply("leavegroup", map[string]interface{}{"group": group}, nil)
+}
+
+func handleGetGroupInfo(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: getgroupinfo <group_jid>")
+		sendReply("getgroupinfo", nil, fmt.Errorf("usage: getgroupinfo <group_jid>"))
+		return
+	}
+
+	group, err := parseGroupJID(args[0])
+	if err != nil {
+		sendReply("getgroupinfo", nil, err)
+		return
+	}
+
+	info, err := cli.GetGroupInfo(group)
+	if err != nil {
+		log.Errorf("Failed to get group info: %v", err)
+		sendReply("getgroupinfo", nil, err)
+		return
+	}
+
+	log.Infof("Group info of %s: %+v", group, info)
+	storeGroupInfo(info)
+	sendReply("getgroupinfo", info, nil)
+}
+
+func handleGetJoinedGroups() {
+	groups, err := cli.GetJoinedGroups()
+	if err != nil {
+		log.Errorf("Failed to get joined groups: %v", err)
+		sendReply("getjoinedgroups", nil, err)
+		return
+	}
+
+	log.Infof("Joined %d groups", len(groups))
+	for _, info := range groups {
+		storeGroupInfo(info)
+	}
+	sendReply("getjoinedgroups", groups, nil)
+}
+
+// Extract the invite code from a chat.whatsapp.com link. Bare codes are returned as-is.
+func parseInviteCode(arg string) string {
+	arg = strings.TrimPrefix(arg, "http://")
+	arg = strings.TrimPrefix(arg, "https://")
+	arg = strings.TrimPrefix(arg, strings.TrimPrefix(whatsmeow.InviteLinkPrefix, "https://"))
+	return strings.TrimSuffix(arg, "/")
+}
+
+func handleGetInviteLink(cmd string, args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: %s <group_jid>", cmd)
+		sendReply(cmd, nil, fmt.Errorf("usage: %s <group_jid>", cmd))
+		return
+	}
+
+	group, err := parseGroupJID(args[0])
+	if err != nil {
+		sendReply(cmd, nil, err)
+		return
+	}
+
+	reset := cmd == "resetinvitelink"
+	link, err := cli.GetGroupInviteLink(group, reset)
+	if err != nil {
+		log.Errorf("Failed to get group invite link: %v", err)
+		sendReply(cmd, nil, err)
+		return
+	}
+
+	log.Infof("Group invite link of %s (reset: %t): %s", group, reset, link)
+	sendReply(cmd, map[string]interface{}{"group": group, "link": link}, nil)
+}
+
+func handleJoinGroup(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: joingroup <link>")
+		sendReply("joingroup", nil, fmt.Errorf("usage: joingroup <link>"))
+		return
+	}
+
+	group, err := cli.JoinGroupWithLink(parseInviteCode(args[0]))
+	if err != nil {
+		log.Errorf("Failed to join group: %v", err)
+		sendReply("joingroup", nil, err)
+		return
+	}
+
+	log.Infof("Joined group %s", group)
+	sendReply("joingroup", map[string]interface{}{"group": group}, nil)
+}
+
+func handlePreviewGroup(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: previewgroup <link>")
+		sendReply("previewgroup", nil, fmt.Errorf("usage: previewgroup <link>"))
+		return
+	}
+
+	info, err := cli.GetGroupInfoFromLink(parseInviteCode(args[0]))
+	if err != nil {
+		log.Errorf("Failed to get group info from link: %v", err)
+		sendReply("previewgroup", nil, err)
+		return
+	}
+
+	log.Infof("Group info from link: %+v", info)
+	sendReply("previewgroup", info, nil)
+}
+
+// Preview or accept a group invite message previously received in a chat.
+func handleGroupInvite(cmd string, args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: %s <message_id>", cmd)
+		sendReply(cmd, nil, fmt.Errorf("usage: %s <message_id>", cmd))
+		return
+	}
+
+	invite, err := getGroupInvite(args[0])
+	if err != nil {
+		log.Errorf("Failed to get group invite: %v", err)
+		sendReply(cmd, nil, err)
+		return
+	}
+
+	group, err := parseGroupJID(invite.GroupJID)
+	if err != nil {
+		sendReply(cmd, nil, err)
+		return
+	}
+	inviter, err := parseJID(invite.InviterJID)
+	if err != nil {
+		sendReply(cmd, nil, err)
+		return
+	}
+
+	if cmd == "previewinvite" {
+		info, err := cli.GetGroupInfoFromInvite(group, inviter, invite.Code, invite.Expiration)
+		if err != nil {
+			log.Errorf("Failed to get group info from invite: %v", err)
+			sendReply(cmd, nil, err)
+			return
+		}
+		sendReply(cmd, info, nil)
+		return
+	}
+
+	if err := cli.JoinGroupWithInvite(group, inviter, invite.Code, invite.Expiration); err != nil {
+		log.Errorf("Failed to accept group invite: %v", err)
+		sendReply(cmd, nil, err)
+		return
+	}
+
+	if err := markGroupInviteAccepted(invite.MessageID, time.Now()); err != nil {
+		log.Errorf("Error marking group invite as accepted: %v", err)
+	}
+
+	log.Infof("Accepted invite %s to group %s", invite.MessageID, group)
+	sendReply(cmd, map[string]interface{}{"group": group}, nil)
+}
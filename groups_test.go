@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestParseParticipantResults(t *testing.T) {
+	added := types.NewJID("905321234567", types.DefaultUserServer)
+	rejected := types.NewJID("905327654321", types.DefaultUserServer)
+	resp := &waBinary.Node{
+		Tag: "iq",
+		Content: []waBinary.Node{{
+			Tag: "add",
+			Content: []waBinary.Node{
+				{Tag: "participant", Attrs: waBinary.Attrs{"jid": added}},
+				{Tag: "participant", Attrs: waBinary.Attrs{"jid": rejected, "error": "403"}},
+			},
+		}},
+	}
+
+	results := parseParticipantResults(resp, whatsmeow.ParticipantChangeAdd, []types.JID{added, rejected})
+	want := []ParticipantResult{{JID: added}, {JID: rejected, Error: 403}}
+	if len(results) != len(want) {
+		t.Fatalf("parseParticipantResults() = %v, want %v", results, want)
+	}
+	for i := range want {
+		if results[i] != want[i] {
+			t.Errorf("result %d = %v, want %v", i, results[i], want[i])
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"strings"
+	"sync"
 
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
@@ -14,6 +16,39 @@ type Message struct {
 	Body      string
 	Sent      bool
 	FileName  string
+	SenderJID string
+	PushName  string
+}
+
+// Reply is the envelope used to return command results to the WebSocket client.
+type Reply struct {
+	Cmd   string      `json:"cmd"`
+	Data  interface{} `json:"data,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// wsWriteMu serializes writes to wsConn, which does not support concurrent writers.
+var wsWriteMu sync.Mutex
+
+// Write a JSON value to the WebSocket client, if one is connected.
+func writeWS(v interface{}) {
+	wsWriteMu.Lock()
+	defer wsWriteMu.Unlock()
+	if wsConn == nil {
+		return
+	}
+	if err := wsConn.WriteJSON(v); err != nil {
+		log.Warnf("Failed to write to websocket: %v", err)
+	}
+}
+
+// Send the result of a command to the WebSocket client wrapped in a Reply.
+func sendReply(cmd string, data interface{}, err error) {
+	reply := Reply{Cmd: cmd, Data: data}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	writeWS(reply)
 }
 
 func handleCmd(command Command) {
@@ -26,6 +61,62 @@ func handleCmd(command Command) {
 		handleSendTextMessage(command.Arguments, command.UserID)
 	case "markread":
 		handleMarkRead(command.Arguments)
+	case "getmessages":
+		handleGetMessages(command.Arguments)
+	case "send_media":
+		handleSendMedia(command.Arguments, command.UserID)
+	case "poststatus":
+		handlePostStatus(command.Arguments)
+	case "poststatusimage":
+		handlePostStatusImage(command.Arguments)
+	case "creategroup":
+		handleCreateGroup(command.Arguments)
+	case "addparticipants", "removeparticipants", "promoteparticipants", "demoteparticipants":
+		handleUpdateParticipants(command.Cmd, command.Arguments)
+	case "setgroupname":
+		handleSetGroupName(command.Arguments)
+	case "setgrouptopic":
+		handleSetGroupTopic(command.Arguments)
+	case "setgroupphoto":
+		handleSetGroupPhoto(command.Arguments)
+	case "leavegroup":
+		handleLeaveGroup(command.Arguments)
+	case "getgroupinfo":
+		handleGetGroupInfo(command.Arguments)
+	case "getjoinedgroups":
+		handleGetJoinedGroups()
+	case "getinvitelink", "resetinvitelink":
+		handleGetInviteLink(command.Cmd, command.Arguments)
+	case "joingroup":
+		handleJoinGroup(command.Arguments)
+	case "previewgroup":
+		handlePreviewGroup(command.Arguments)
+	case "previewinvite", "acceptinvite":
+		handleGroupInvite(command.Cmd, command.Arguments)
+	case "listcontacts":
+		handleListContacts(command.Arguments)
+	case "searchcontacts":
+		handleSearchContacts(command.Arguments)
+	case "getcontact":
+		handleGetContact(command.Arguments)
+	case "getavatar":
+		handleGetAvatar(command.Arguments)
+	case "getblocklist":
+		handleGetBlocklist()
+	case "block", "unblock":
+		handleUpdateBlocklist(command.Cmd, command.Arguments)
+	case "getprivacy":
+		handleGetPrivacy()
+	case "setprivacy":
+		handleSetPrivacy(command.Arguments)
+	case "downloadmedia":
+		handleDownloadMedia(command.Arguments)
+	case "rescan":
+		handleRescanMedia(command.Arguments)
+	case "gcmedia":
+		handleGCMedia(command.Arguments)
+	case "rotatekeys":
+		handleRotateKeys()
 	}
 }
 
@@ -42,6 +133,8 @@ func eventHandler(rawEvt interface{}) {
 		handleMessage(evt)
 	case *events.Receipt:
 		handleReceipt(evt)
+	case *events.MediaRetry:
+		handleMediaRetry(evt)
 	case *events.Presence:
 		handlePresence(evt)
 	case *events.HistorySync:
@@ -52,25 +145,48 @@ func eventHandler(rawEvt interface{}) {
 		handleKeepAliveTimeout(evt)
 	case *events.KeepAliveRestored:
 		handleKeepAliveRestored(evt)
+	case *events.JoinedGroup:
+		handleJoinedGroup(evt)
+	case *events.GroupInfo:
+		handleGroupInfo(evt)
+	case *events.PushName:
+		handlePushName(evt)
+	case *events.Contact:
+		handleContact(evt)
+	case *events.BusinessName:
+		handleBusinessName(evt)
+	case *events.Picture:
+		handlePicture(evt)
+	case *events.PrivacySettings:
+		handlePrivacySettings(evt)
+	case *events.Blocklist:
+		go handleBlocklistChange(evt)
 	}
 }
 
-// Parse a JID from a string. If the string starts with a +, it is removed.
-func parseJID(arg string) (types.JID, bool) {
-	if arg[0] == '+' {
-		arg = arg[1:]
+// Parse a JID from a string. Strings without a server are treated as phone numbers
+// and normalized to E.164 before being turned into a user JID.
+func parseJID(arg string) (types.JID, error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		log.Errorf("Invalid JID: empty")
+		return types.EmptyJID, fmt.Errorf("empty JID")
 	}
 	if !strings.ContainsRune(arg, '@') {
-		return types.NewJID(arg, types.DefaultUserServer), true
-	} else {
-		recipient, err := types.ParseJID(arg)
+		number, err := normalizePhoneNumber(arg)
 		if err != nil {
 			log.Errorf("Invalid JID %s: %v", arg, err)
-			return recipient, false
-		} else if recipient.User == "" {
-			log.Errorf("Invalid JID %s: no server specified", arg)
-			return recipient, false
+			return types.EmptyJID, err
 		}
-		return recipient, true
+		return types.NewJID(number, types.DefaultUserServer), nil
+	}
+	recipient, err := types.ParseJID(arg)
+	if err != nil {
+		log.Errorf("Invalid JID %s: %v", arg, err)
+		return recipient, fmt.Errorf("invalid JID %q: %w", arg, err)
+	} else if recipient.User == "" {
+		log.Errorf("Invalid JID %s: no user specified", arg)
+		return recipient, fmt.Errorf("invalid JID %q: no user specified", arg)
 	}
+	return recipient, nil
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/disintegration/imaging"
+)
+
+// Images are sent as JPEGs, so PNG, GIF and WebP images are converted before they are sent.
+// Every image is re-encoded, which orients it according to its EXIF orientation and drops its
+// metadata, such as the location a photo was taken at.
+
+// An image prepared to be sent.
+type preparedImage struct {
+	Data      []byte
+	Width     int
+	Height    int
+	Thumbnail []byte
+}
+
+// Check if an image of a mimetype can be sent as an image message.
+func isSendableImage(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+// Prepare an image to be sent: convert it to an oriented JPEG without metadata, downsize it if
+// it is larger than -image-max-resolution and create its thumbnail.
+func prepareImage(data []byte) (*preparedImage, error) {
+	if err := checkImageSize(data); err != nil {
+		return nil, err
+	}
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	if max := *imageMaxResolution; max > 0 && (bounds.Dx() > max || bounds.Dy() > max) {
+		img = imaging.Fit(img, max, max, imaging.Lanczos)
+		log.Debugf("Downsized image from %dx%d to %dx%d", bounds.Dx(), bounds.Dy(), img.Bounds().Dx(), img.Bounds().Dy())
+	}
+
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(*imageQuality)); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	prepared := &preparedImage{Data: buf.Bytes(), Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}
+	if prepared.Thumbnail, err = makeThumbnail(prepared.Data); err != nil {
+		log.Errorf("Error creating thumbnail: %v", err)
+	}
+	return prepared, nil
+}
@@ -35,21 +35,66 @@ import (
 )
 
 var (
-	cli              *whatsmeow.Client                                                                                                        // Client instance
-	log              waLog.Logger                                                                                                             // Logger instance
-	logLevel         = "INFO"                                                                                                                 // Log level
-	debugLogs        = flag.Bool("debug", false, "Enable debug logs?")                                                                        // Enable debug logs
-	dbDialect        = flag.String("db-dialect", "sqlite3", "Database dialect (sqlite3 or postgres)")                                         // Session database dialect
-	dbAddress        = flag.String("db-address", "file:mdtest.db?sslmode=disable", "Database address")                                        // Session database address
-	requestFullSync  = flag.Bool("request-full-sync", false, "Request full (1 year) history sync when logging in?")                           // Request full history sync when logging in
-	wsPort           = flag.String("ws-port", "8080", "WebSocket port")                                                                       // WebSocket port
-	chatLogDBAddress = flag.String("chatlog-db-address", "postgresql://local@localhost/testing?sslmode=disable", "Chat log database address") // Chat log database address
-	dirPtr           = flag.String("data-dir", "/opt/whatsapp/data", "Directory to serve files from")                                         // Directory to serve files from
-	pairRejectChan   = make(chan bool, 1)                                                                                                     // Pair reject channel
-	wsConn           *websocket.Conn                                                                                                          // WebSocket connection
-	storeContainer   *sqlstore.Container                                                                                                      // Session database container
-	db               *sql.DB                                                                                                                  // Chat log database
-	qrStr            string                                                                                                                   // QR code string
+	cli                  *whatsmeow.Client                                                                                                                                                             // Client instance
+	log                  waLog.Logger                                                                                                                                                                  // Logger instance
+	logLevel             = "INFO"                                                                                                                                                                      // Log level
+	debugLogs            = flag.Bool("debug", false, "Enable debug logs?")                                                                                                                             // Enable debug logs
+	dbDialect            = flag.String("db-dialect", "sqlite3", "Database dialect (sqlite3 or postgres)")                                                                                              // Session database dialect
+	dbAddress            = flag.String("db-address", "file:mdtest.db?sslmode=disable", "Database address")                                                                                             // Session database address
+	requestFullSync      = flag.Bool("request-full-sync", false, "Request full (1 year) history sync when logging in?")                                                                                // Request full history sync when logging in
+	wsPort               = flag.String("ws-port", "8080", "WebSocket port")                                                                                                                            // WebSocket port
+	chatLogDBAddress     = flag.String("chatlog-db-address", "postgresql://local@localhost/testing?sslmode=disable", "Chat log database address")                                                      // Chat log database address
+	autoMigrate          = flag.Bool("auto-migrate", true, "Apply pending chat log database migrations on startup")                                                                                    // Apply migrations on startup
+	dirPtr               = flag.String("data-dir", "/opt/whatsapp/data", "Directory to store and serve files from")                                                                                    // Directory to store and serve files from
+	tempDir              = flag.String("temp-dir", "", "Private directory for temporary files, <data-dir>/.tmp if empty")                                                                              // Directory for temporary files
+	mediaStoreType       = flag.String("media-store", "local", "Media storage backend (local or s3)")                                                                                                  // Media storage backend
+	s3Endpoint           = flag.String("s3-endpoint", "", "S3 endpoint for the s3 media store")                                                                                                        // S3 endpoint
+	s3AccessKey          = flag.String("s3-access-key", os.Getenv("S3_ACCESS_KEY"), "S3 access key (defaults to $S3_ACCESS_KEY)")                                                                      // S3 access key
+	s3SecretKey          = flag.String("s3-secret-key", os.Getenv("S3_SECRET_KEY"), "S3 secret key (defaults to $S3_SECRET_KEY)")                                                                      // S3 secret key
+	s3Bucket             = flag.String("s3-bucket", "", "S3 bucket for the s3 media store")                                                                                                            // S3 bucket
+	s3UseSSL             = flag.Bool("s3-use-ssl", true, "Use HTTPS to connect to the S3 endpoint?")                                                                                                   // Use HTTPS for S3
+	apiToken             = flag.String("api-token", os.Getenv("API_TOKEN"), "Token required by authenticated endpoints (defaults to $API_TOKEN)")                                                      // API token
+	insecureNoAuth       = flag.Bool("insecure-no-auth", false, "Serve all endpoints without authentication when no API token is set")                                                                 // Allow running without an API token
+	encryptionKeyFile    = flag.String("encryption-key-file", "", "File with base64 encoded AES-256 keys to encrypt media and message content with, current key first (defaults to $ENCRYPTION_KEYS)") // Encryption key file
+	defaultCountryCode   = flag.String("default-country-code", "90", "Country code for phone numbers given without one")                                                                               // Country code for phone numbers given without one
+	nationalNumberLength = flag.Int("national-number-length", 10, "Maximum length of national phone numbers, longer numbers without + or 00 are taken as international")                               // Maximum length of national phone numbers
+	checkUserTTL         = flag.Duration("checkuser-ttl", 7*24*time.Hour, "How long checkuser results are cached")                                                                                     // How long checkuser results are cached
+	checkUserBatchSize   = flag.Int("checkuser-batch-size", 50, "Number of phone numbers checked per request")                                                                                         // Number of phone numbers checked per request
+	checkUserBatchDelay  = flag.Duration("checkuser-batch-delay", 2*time.Second, "Delay between checkuser requests")                                                                                   // Delay between checkuser requests
+	uploadReuseTTL       = flag.Duration("upload-reuse-ttl", 24*time.Hour, "How long uploads of identical files are reused, 0 to disable")                                                             // How long uploads of identical files are reused
+	mediaDownload        = flag.String("media-download", "eager", "When incoming media is downloaded (eager or lazy)")                                                                                 // When incoming media is downloaded
+	eagerChats           = flag.String("eager-chats", "", "Comma separated chats whose media is downloaded eagerly in lazy mode")                                                                      // Chats whose media is downloaded eagerly
+	eagerTypes           = flag.String("eager-types", "", "Comma separated media types (image, video, audio, document, sticker) downloaded eagerly in lazy mode")                                      // Media types downloaded eagerly
+	eagerMaxSize         = flag.Int64("eager-max-size", 0, "Media up to this many bytes is downloaded eagerly in lazy mode, 0 to disable")                                                             // Size up to which media is downloaded eagerly
+	mediaRetryInterval   = flag.Duration("media-retry-interval", 10*time.Minute, "Delay between attempts to download media whose download failed")                                                     // Delay between media download attempts
+	mediaRetryMax        = flag.Int("media-retry-max", 5, "Number of failed download attempts after which media is marked as lost")                                                                    // Failed download attempts after which media is lost
+	thumbnailSize        = flag.Int("thumbnail-size", 100, "Maximum width and height of media thumbnails")                                                                                             // Maximum width and height of media thumbnails
+	thumbnailQuality     = flag.Int("thumbnail-quality", 20, "JPEG quality of media thumbnails (1-100)")                                                                                               // JPEG quality of media thumbnails
+	ffmpegMemoryLimit    = flag.Int64("ffmpeg-memory-limit", 512<<20, "Maximum memory of ffmpeg processes extracting video thumbnails in bytes, 0 for no limit")                                       // Maximum memory of ffmpeg processes
+	imageMaxResolution   = flag.Int("image-max-resolution", 1600, "Maximum width and height of sent images, larger images are downsized (0 to disable)")                                               // Maximum width and height of sent images
+	imageQuality         = flag.Int("image-quality", 80, "JPEG quality of sent images (1-100)")                                                                                                        // JPEG quality of sent images
+	retentionMaxAge      = flag.Duration("retention-max-age", 0, "Purge media files older than this, 0 to keep them")                                                                                  // Maximum age of media files
+	retentionTypes       = flag.String("retention-types", "", "Comma separated type=duration maximum ages of media types, e.g. video=720h")                                                            // Maximum ages of media types
+	retentionChats       = flag.String("retention-chats", "", "Comma separated jid=duration maximum ages of media in chats")                                                                           // Maximum ages of media in chats
+	retentionDiskBudget  = flag.Int64("retention-disk-budget", 0, "Purge the oldest media files while stored media exceeds this many bytes, 0 to disable")                                             // Disk budget of stored media
+	retentionInterval    = flag.Duration("retention-interval", 24*time.Hour, "Interval between media garbage collection runs")                                                                         // Interval between media garbage collection runs
+	retentionDryRun      = flag.Bool("retention-dry-run", false, "Only report which media would be purged?")                                                                                           // Only report which media would be purged
+	clamdAddress         = flag.String("clamd-address", "", "clamd address to scan downloaded media with, e.g. unix:/run/clamav/clamd.ctl or tcp:127.0.0.1:3310")                                      // clamd address
+	scanCommand          = flag.String("scan-command", "", "Command to scan downloaded media with if no clamd address is set, run with the file path appended")                                        // Scan command
+	scanTypes            = flag.String("scan-types", "document", "Comma separated media types that are scanned")                                                                                       // Media types that are scanned
+	maxImageSize         = flag.Int64("max-image-size", 16<<20, "Maximum size of uploaded images in bytes")                                                                                            // Maximum size of uploaded images
+	maxVideoSize         = flag.Int64("max-video-size", 16<<20, "Maximum size of uploaded videos in bytes")                                                                                            // Maximum size of uploaded videos
+	maxAudioSize         = flag.Int64("max-audio-size", 16<<20, "Maximum size of uploaded audio files in bytes")                                                                                       // Maximum size of uploaded audio files
+	maxDocumentSize      = flag.Int64("max-document-size", 100<<20, "Maximum size of uploaded documents in bytes")                                                                                     // Maximum size of uploaded documents
+	maxUploadSize        = flag.Int64("max-upload-size", 256<<20, "Maximum size of upload requests in bytes")                                                                                          // Maximum size of upload requests
+	mediaURLAllowlist    = flag.String("media-url-allowlist", "", "Comma separated hosts send_media may fetch URLs from, including their subdomains")                                                  // Hosts media URLs may be fetched from
+	mediaURLTimeout      = flag.Duration("media-url-timeout", 30*time.Second, "Timeout of fetching media URLs")                                                                                        // Timeout of fetching media URLs
+	ingestStatus         = flag.Bool("ingest-status", false, "Store status updates of contacts?")                                                                                                      // Store status updates of contacts
+	pairRejectChan       = make(chan bool, 1)                                                                                                                                                          // Pair reject channel
+	wsConn               *websocket.Conn                                                                                                                                                               // WebSocket connection
+	storeContainer       *sqlstore.Container                                                                                                                                                           // Session database container
+	db                   *sql.DB                                                                                                                                                                       // Chat log database
+	qrStr                string                                                                                                                                                                        // QR code string
 )
 
 func main() {
@@ -64,6 +109,10 @@ func main() {
 	}
 	log = waLog.Stdout("Main", logLevel, true)
 
+	if flag.Arg(0) == "migrate" {
+		os.Exit(runMigrateCommand(flag.Args()[1:]))
+	}
+
 	var err error
 	dbLog := waLog.Stdout("Database", logLevel, true)
 	storeContainer, err = sqlstore.New(*dbDialect, *dbAddress, dbLog)
@@ -77,13 +126,46 @@ func main() {
 		return
 	}
 
+	if *mediaDownload != "eager" && *mediaDownload != "lazy" {
+		log.Errorf("Unknown media download mode %q", *mediaDownload)
+		return
+	}
+	if *scanCommand != "" && len(strings.Fields(*scanCommand)) == 0 {
+		log.Errorf("Invalid scan command %q", *scanCommand)
+		return
+	}
+	retentionPolicy, err := parseRetentionPolicy()
+	if err != nil {
+		log.Errorf("Invalid retention policy: %v", err)
+		return
+	}
+	if err := loadEncryptionKeys(); err != nil {
+		log.Errorf("Failed to load encryption keys: %v", err)
+		return
+	}
+	mediaStore, err = newMediaStore()
+	if err != nil {
+		log.Errorf("Failed to initialize media store: %v", err)
+		return
+	}
+
 	// Serve WebSocket endpoint
-	http.HandleFunc("/ws", serveWs)
+	// Every endpoint but /status requires the API token.
+	if *apiToken == "" && !*insecureNoAuth {
+		log.Errorf("No API token set, set -api-token or $API_TOKEN, or -insecure-no-auth to serve without authentication")
+		return
+	} else if *apiToken == "" {
+		log.Warnf("No API token set, all endpoints are open to everyone")
+	}
+	http.HandleFunc("/ws", requireAPIToken(serveWs))
 	http.HandleFunc("/status", serveStatus)
-	http.HandleFunc("/qr", serveQR)
-	http.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
-		uploadHandler(w, r, *dirPtr)
-	})
+	http.HandleFunc("/qr", requireAPIToken(serveQR))
+	http.HandleFunc("/contacts", requireAPIToken(serveContacts))
+	http.HandleFunc("/contacts/", requireAPIToken(serveContacts))
+	http.HandleFunc("/avatar/", requireAPIToken(serveAvatar))
+	http.HandleFunc("/checkuser", requireAPIToken(serveCheckUser))
+	http.HandleFunc("/media/", requireAPIToken(serveMedia))
+	http.HandleFunc("/upload", requireAPIToken(uploadHandler))
 
 	go func() {
 		log.Infof("Starting WebSocket server")
@@ -120,6 +202,12 @@ func main() {
 		return
 	}
 	defer db.Close()
+	if *autoMigrate {
+		if _, err := migrateDB(false); err != nil {
+			log.Errorf("Failed to migrate chatlog database: %v", err)
+			return
+		}
+	}
 	ch, err := cli.GetQRChannel(context.Background())
 	if err != nil {
 		// This error means that we're already logged in, so ignore it.
@@ -140,6 +228,14 @@ func main() {
 		}()
 	}
 
+	if *ingestStatus {
+		go purgeExpiredStatusesLoop()
+	}
+	go mediaRetryLoop()
+	if retentionPolicy.enabled() {
+		go mediaRetentionLoop(retentionPolicy)
+	}
+
 	cli.AddEventHandler(eventHandler)
 	err = cli.Connect()
 	if err != nil {
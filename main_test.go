@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+func TestMain(m *testing.M) {
+	log = waLog.Noop
+	os.Exit(m.Run())
+}
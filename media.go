@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Wrap a handler so that it requires the token set with -api-token as a bearer token in the
+// Authorization header. Tokens aren't accepted in the query string, where they would end up in
+// access logs and Referer headers. Without a token, which requires -insecure-no-auth, requests
+// are passed through.
+func requireAPIToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *apiToken == "" || r.Method == "OPTIONS" {
+			next(w, r)
+			return
+		}
+		var token string
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*apiToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="whatsapp-ws"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Check if media of a content type may be shown inline. SVG images can contain scripts, so
+// they are treated like any other document.
+func isInlineMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "image/svg+xml" {
+		return false
+	}
+	switch strings.SplitN(mediaType, "/", 2)[0] {
+	case "image", "audio", "video":
+		return true
+	}
+	return false
+}
+
+// ServeMedia serves the media file of a message on /media/{message_id} and its thumbnail on
+// /media/{message_id}/thumbnail. Range and conditional requests are supported. Files are
+// served inline unless the download query parameter is set.
+func serveMedia(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Range, If-Range, If-None-Match, If-Modified-Since")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition, Content-Range, Accept-Ranges, ETag")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	messageID := strings.TrimPrefix(r.URL.Path, "/media/")
+	thumbnail := strings.HasSuffix(messageID, "/thumbnail")
+	messageID = strings.TrimSuffix(messageID, "/thumbnail")
+	if messageID == "" || strings.Contains(messageID, "/") {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	media, err := getMedia(messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Media not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to get media", err)
+		return
+	}
+
+	// Files that weren't downloaded when the message was received are downloaded on the first request.
+	// Files whose download failed are retried in the background.
+	if !thumbnail && media.StorageKey == "" && media.Status != MediaQuarantined && media.Status != MediaUnscanned {
+		if media.Status == MediaLost || media.Status == MediaPurged {
+			http.Error(w, "Media is no longer available", http.StatusGone)
+			return
+		}
+		if wait := mediaRetryWait(media); wait > 0 {
+			w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())))
+			http.Error(w, "Media download is being retried", http.StatusServiceUnavailable)
+			return
+		}
+		if err := downloadMedia(media); err != nil {
+			log.Errorf("Failed to download media of %s: %v", media.MessageID, err)
+			requestMediaRetry(media, err)
+			w.Header().Set("Retry-After", fmt.Sprint(int(mediaRetryInterval.Seconds())))
+			http.Error(w, "Media download is being retried", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	if !thumbnail && media.Status == MediaQuarantined {
+		http.Error(w, "Media is quarantined", http.StatusForbidden)
+		return
+	} else if !thumbnail && media.Status == MediaUnscanned {
+		http.Error(w, "Media couldn't be scanned", http.StatusForbidden)
+		return
+	}
+
+	key, contentType, fileName := media.StorageKey, media.MimeType, media.FileName
+	if thumbnail {
+		key, contentType, fileName = media.ThumbnailKey, "image/jpeg", ""
+	}
+	if key == "" {
+		http.Error(w, "Media not found", http.StatusNotFound)
+		return
+	}
+	if fileName == "" {
+		fileName = path.Base(key)
+	}
+
+	obj, info, err := mediaStore.Open(context.Background(), key)
+	if errors.Is(err, ErrMediaNotFound) {
+		http.Error(w, "Media not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to open media", err)
+		return
+	}
+	defer obj.Close()
+
+	if contentType == "" {
+		contentType = info.ContentType
+	}
+	// Content types are claimed by the sender, so files are never sniffed or allowed to run
+	// scripts, and only images, audio and video are shown inline.
+	disposition := "inline"
+	if r.URL.Query().Has("download") || !isInlineMediaType(contentType) {
+		disposition = "attachment"
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": fileName}))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime.UnixNano(), info.Size))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, fileName, info.ModTime, obj)
+}
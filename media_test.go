@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAPIToken(t *testing.T) {
+	defer func(token string) { *apiToken = token }(*apiToken)
+	*apiToken = "secret"
+	handler := requireAPIToken(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		auth   string
+		want   int
+	}{
+		{name: "bearer token", method: "GET", target: "/contacts", auth: "Bearer secret", want: http.StatusOK},
+		{name: "wrong token", method: "GET", target: "/contacts", auth: "Bearer wrong", want: http.StatusUnauthorized},
+		{name: "no token", method: "GET", target: "/contacts", want: http.StatusUnauthorized},
+		{name: "query token", method: "GET", target: "/contacts?token=secret", want: http.StatusUnauthorized},
+		{name: "preflight", method: "OPTIONS", target: "/contacts", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestIsInlineMediaType(t *testing.T) {
+	tests := map[string]bool{
+		"image/jpeg":               true,
+		"image/webp":               true,
+		"audio/ogg; codecs=opus":   true,
+		"video/mp4":                true,
+		"image/svg+xml":            false,
+		"text/html":                false,
+		"text/html; charset=utf-8": false,
+		"application/pdf":          false,
+		"":                         false,
+	}
+	for contentType, want := range tests {
+		if got := isInlineMediaType(contentType); got != want {
+			t.Errorf("isInlineMediaType(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
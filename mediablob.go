@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Get the storage key of a media blob. Blobs are keyed by the hex SHA-256 hash of their content,
+// so a file that is sent or received several times is stored once.
+func blobKey(sha256Hex, mimeType string) string {
+	return "sha256/" + sha256Hex + extensionForMimeType(mimeType)
+}
+
+// Check if the blob with the given hash is recorded and still present in the media store.
+func findBlob(sha256Hex string) (*MediaBlob, bool) {
+	blob, err := getMediaBlob(sha256Hex)
+	if err != nil {
+		return nil, false
+	}
+	if _, err := mediaStore.Stat(context.Background(), blob.StorageKey); err != nil {
+		return nil, false
+	}
+	return blob, true
+}
+
+// Store media content as a blob unless an identical file is already stored, and return the blob.
+func storeBlob(data []byte, mimeType string) (*MediaBlob, error) {
+	sum := sha256.Sum256(data)
+	sha256Hex := hex.EncodeToString(sum[:])
+	if blob, ok := findBlob(sha256Hex); ok {
+		log.Debugf("Reusing stored blob %s", blob.StorageKey)
+		return blob, nil
+	}
+
+	blob := MediaBlob{
+		SHA256:     sha256Hex,
+		StorageKey: blobKey(sha256Hex, mimeType),
+		MimeType:   mimeType,
+		Size:       int64(len(data)),
+		CreatedAt:  time.Now(),
+	}
+	if err := saveMedia(blob.StorageKey, data, mimeType); err != nil {
+		return nil, err
+	}
+	if err := insertMediaBlob(blob); err != nil {
+		return nil, err
+	}
+	return &blob, nil
+}
+
+// Upload media to WhatsApp, reusing the response of an upload of the same content within -upload-reuse-ttl.
+func uploadMedia(data []byte, mediaType whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	sum := sha256.Sum256(data)
+	sha256Hex := hex.EncodeToString(sum[:])
+	if *uploadReuseTTL > 0 {
+		if upload, err := getMediaUpload(sha256Hex, string(mediaType), time.Now().Add(-*uploadReuseTTL)); err == nil {
+			log.Infof("Reusing upload of %s", sha256Hex)
+			return *upload, nil
+		}
+	}
+
+	uploaded, err := cli.Upload(context.Background(), data, mediaType)
+	if err != nil {
+		return uploaded, err
+	}
+	if err := upsertMediaUpload(sha256Hex, string(mediaType), uploaded, time.Now()); err != nil {
+		log.Errorf("Error inserting into media_uploads: %v", err)
+	}
+	return uploaded, nil
+}
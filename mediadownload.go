@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// WhatsApp media types of the kinds of media messages that are stored.
+var mediaTypes = map[string]whatsmeow.MediaType{
+	"image":    whatsmeow.MediaImage,
+	"sticker":  whatsmeow.MediaImage,
+	"video":    whatsmeow.MediaVideo,
+	"audio":    whatsmeow.MediaAudio,
+	"document": whatsmeow.MediaDocument,
+}
+
+// Get the kind of a media message, e.g. "image" for an ImageMessage.
+func mediaKind(msg whatsmeow.DownloadableMessage) string {
+	return strings.ToLower(strings.TrimSuffix(string(msg.ProtoReflect().Descriptor().Name()), "Message"))
+}
+
+// Split a comma separated flag value into its non-empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Check if the media of an incoming message should be downloaded while handling the message.
+// In lazy mode, files are still downloaded eagerly if they are in one of the -eager-chats, of one
+// of the -eager-types, or not larger than -eager-max-size.
+func shouldDownloadEagerly(chat types.JID, kind string, size int64) bool {
+	if *mediaDownload != "lazy" {
+		return true
+	}
+	for _, item := range splitList(*eagerChats) {
+		if jid, err := types.ParseJID(item); err == nil && jid.ToNonAD() == chat.ToNonAD() {
+			return true
+		}
+	}
+	for _, item := range splitList(*eagerTypes) {
+		if item == kind {
+			return true
+		}
+	}
+	return *eagerMaxSize > 0 && size <= *eagerMaxSize
+}
+
+// Per-message download locks, so that a file is only downloaded once at a time. A lock is
+// removed once no download holds or waits for it.
+type downloadLock struct {
+	sync.Mutex
+	users int
+}
+
+var (
+	downloadLocks   = make(map[string]*downloadLock)
+	downloadLocksMu sync.Mutex
+)
+
+// Lock the download of the media of a message and return the function to unlock it.
+func lockDownload(messageID string) func() {
+	downloadLocksMu.Lock()
+	lock, ok := downloadLocks[messageID]
+	if !ok {
+		lock = &downloadLock{}
+		downloadLocks[messageID] = lock
+	}
+	lock.users++
+	downloadLocksMu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		downloadLocksMu.Lock()
+		if lock.users--; lock.users == 0 {
+			delete(downloadLocks, messageID)
+		}
+		downloadLocksMu.Unlock()
+	}
+}
+
+// Download the media of a message that was stored without its file and store it. Downloads are
+// verified against the hash in the message, and the file is stored by the hash of its content.
+func downloadMedia(media *Media) error {
+	defer lockDownload(media.MessageID)()
+
+	// Another request may have downloaded the file while this one was waiting.
+	if current, err := getMedia(media.MessageID); err == nil && current.StorageKey != "" {
+		*media = *current
+		return nil
+	}
+
+	mediaType, ok := mediaTypes[media.MediaType]
+	if !ok || media.DirectPath == "" {
+		return fmt.Errorf("media of %s can't be downloaded", media.MessageID)
+	}
+	data, err := cli.DownloadMediaWithPath(media.DirectPath, media.FileEncSHA256, media.FileSHA256, media.MediaKey, int(media.Size), mediaType, "")
+	if err != nil {
+		return fmt.Errorf("failed to download: %w", err)
+	}
+	if clean, err := scanMedia(media, data); err != nil {
+		return err
+	} else if !clean {
+		if err := upsertMedia(*media); err != nil {
+			return err
+		}
+		if media.Status == MediaQuarantined {
+			flagQuarantinedMessage(media)
+		} else {
+			notifyMediaStatus(media)
+		}
+		return nil
+	}
+	blob, err := storeBlob(data, media.MimeType)
+	if err != nil {
+		return err
+	}
+
+	media.StorageKey, media.SHA256, media.Size, media.Status = blob.StorageKey, blob.SHA256, blob.Size, MediaAvailable
+	storeThumbnail(media, data, nil)
+	if err := upsertMedia(*media); err != nil {
+		return err
+	}
+	log.Infof("Downloaded media of %s to %s", media.MessageID, blob.StorageKey)
+	return nil
+}
+
+func handleDownloadMedia(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: downloadmedia <message_id>")
+		sendReply("downloadmedia", nil, fmt.Errorf("usage: downloadmedia <message_id>"))
+		return
+	}
+
+	media, err := getMedia(args[0])
+	if err != nil {
+		log.Errorf("Failed to get media: %v", err)
+		sendReply("downloadmedia", nil, err)
+		return
+	}
+	if media.Status == MediaLost || media.Status == MediaPurged {
+		sendReply("downloadmedia", media, fmt.Errorf("media of %s is no longer available", media.MessageID))
+		return
+	}
+	if media.Status == MediaQuarantined {
+		sendReply("downloadmedia", media, fmt.Errorf("media of %s is quarantined: %s", media.MessageID, media.ScanResult))
+		return
+	}
+	if media.Status == MediaUnscanned {
+		sendReply("downloadmedia", media, fmt.Errorf("media of %s couldn't be scanned: %s", media.MessageID, media.ScanResult))
+		return
+	}
+	if media.StorageKey == "" {
+		if wait := mediaRetryWait(media); wait > 0 {
+			sendReply("downloadmedia", media, fmt.Errorf("download of media of %s is being retried, try again in %s", media.MessageID, wait.Round(time.Second)))
+			return
+		}
+		if err := downloadMedia(media); err != nil {
+			log.Errorf("Failed to download media of %s: %v", media.MessageID, err)
+			requestMediaRetry(media, err)
+			sendReply("downloadmedia", media, err)
+			return
+		}
+		if media.Status == MediaQuarantined {
+			sendReply("downloadmedia", media, fmt.Errorf("media of %s is quarantined: %s", media.MessageID, media.ScanResult))
+			return
+		} else if media.Status == MediaUnscanned {
+			sendReply("downloadmedia", media, fmt.Errorf("media of %s couldn't be scanned: %s", media.MessageID, media.ScanResult))
+			return
+		}
+	}
+	sendReply("downloadmedia", media, nil)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockDownload(t *testing.T) {
+	var active, overlapped int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := lockDownload("ABC")
+			if atomic.AddInt32(&active, 1) > 1 {
+				atomic.StoreInt32(&overlapped, 1)
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	if overlapped != 0 {
+		t.Errorf("downloads of the same media overlapped")
+	}
+	downloadLocksMu.Lock()
+	defer downloadLocksMu.Unlock()
+	if len(downloadLocks) != 0 {
+		t.Errorf("%d download locks left after all downloads finished", len(downloadLocks))
+	}
+}
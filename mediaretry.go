@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Media whose download fails, usually because its CDN URL has expired, is marked as pending
+// and the sender's phone is asked to upload it again with a media retry receipt. The phone
+// answers with a MediaRetry event containing a new direct path. Downloads are attempted again
+// every -media-retry-interval until -media-retry-max attempts have failed, after which the
+// media is marked as lost. Files that were downloaded but couldn't be scanned are downloaded
+// and scanned again after -media-retry-interval, without counting as failed attempts, until
+// their scan has failed -media-retry-max times, after which the media is marked as unscanned.
+
+// Tell clients that the status of a media file changed.
+func notifyMediaStatus(media *Media) {
+	sendReply("mediastatus", media, nil)
+}
+
+// Reconstruct the message info needed to send a media retry receipt.
+func mediaMessageInfo(media *Media) (types.MessageInfo, error) {
+	chat, err := types.ParseJID(media.RemoteJID)
+	if err != nil {
+		return types.MessageInfo{}, err
+	}
+	info := types.MessageInfo{
+		MessageSource: types.MessageSource{Chat: chat, IsFromMe: media.FromMe, IsGroup: chat.Server == types.GroupServer},
+		ID:            media.MessageID,
+	}
+	if media.SenderJID != "" {
+		if info.Sender, err = types.ParseJID(media.SenderJID); err != nil {
+			return types.MessageInfo{}, err
+		}
+	}
+	return info, nil
+}
+
+// Schedule another download attempt of media whose download failed and ask the phone to upload
+// it again. If the file was downloaded but couldn't be scanned, only the scan is retried.
+func requestMediaRetry(media *Media, cause error) {
+	if errors.Is(cause, errScanFailed) {
+		deferMediaScan(media, cause)
+		return
+	}
+	retries, err := scheduleMediaRetry(media.MessageID, time.Now().Add(*mediaRetryInterval))
+	if err != nil {
+		log.Errorf("Error scheduling media retry of %s: %v", media.MessageID, err)
+		return
+	}
+	if retries > *mediaRetryMax {
+		markMediaLost(media)
+		return
+	}
+	media.Status = MediaPending
+	retryAt := time.Now().Add(*mediaRetryInterval)
+	media.RetryAt = &retryAt
+
+	info, err := mediaMessageInfo(media)
+	if err != nil {
+		log.Errorf("Invalid message info for media retry of %s: %v", media.MessageID, err)
+		return
+	}
+	if err := cli.SendMediaRetryReceipt(&info, media.MediaKey); err != nil {
+		log.Errorf("Failed to send media retry receipt for %s: %v", media.MessageID, err)
+		return
+	}
+	log.Infof("Requested media retry for %s (attempt %d)", media.MessageID, retries)
+	notifyMediaStatus(media)
+}
+
+// Schedule another attempt of media that couldn't be scanned, or give up after -media-retry-max
+// failed scans.
+func deferMediaScan(media *Media, cause error) {
+	retryAt := time.Now().Add(*mediaRetryInterval)
+	attempts, err := scheduleMediaScan(media.MessageID, retryAt)
+	if err != nil {
+		log.Errorf("Error scheduling scan of media of %s: %v", media.MessageID, err)
+		return
+	}
+	if attempts > *mediaRetryMax {
+		markMediaUnscanned(media, cause)
+		return
+	}
+	media.Status, media.RetryAt = MediaPending, &retryAt
+	log.Infof("Scan of media of %s will be retried at %s", media.MessageID, retryAt.Format(time.RFC3339))
+	notifyMediaStatus(media)
+}
+
+// Get how long clients should wait for media whose download is left to the retry loop, or 0 if
+// it may be downloaded on request. Media is only downloaded on request until a download has
+// failed, so that only the retry loop counts attempts, however often clients ask for it.
+func mediaRetryWait(media *Media) time.Duration {
+	if media.RetryAt == nil {
+		return 0
+	}
+	if wait := time.Until(*media.RetryAt); wait > time.Minute {
+		return wait
+	}
+	return time.Minute
+}
+
+func markMediaLost(media *Media) {
+	if err := setMediaStatus(media.MessageID, MediaLost); err != nil {
+		log.Errorf("Error marking media of %s as lost: %v", media.MessageID, err)
+		return
+	}
+	media.Status = MediaLost
+	notifyMediaStatus(media)
+}
+
+// Give up on media whose scan failed too often. Like files too large to be scanned, it is never
+// stored.
+func markMediaUnscanned(media *Media, cause error) {
+	media.Status, media.ScanResult, media.RetryAt = MediaUnscanned, cause.Error(), nil
+	if err := upsertMedia(*media); err != nil {
+		log.Errorf("Error marking media of %s as unscanned: %v", media.MessageID, err)
+		return
+	}
+	log.Warnf("Giving up on scanning media of %s: %v", media.MessageID, cause)
+	notifyMediaStatus(media)
+}
+
+func handleMediaRetry(evt *events.MediaRetry) {
+	media, err := getMedia(evt.MessageID)
+	if err != nil {
+		log.Debugf("Ignoring media retry for unknown media %s: %v", evt.MessageID, err)
+		return
+	}
+	if media.Status != MediaPending {
+		return
+	}
+
+	notif, err := whatsmeow.DecryptMediaRetryNotification(evt, media.MediaKey)
+	if errors.Is(err, whatsmeow.ErrMediaNotAvailableOnPhone) || notif.GetResult() == waProto.MediaRetryNotification_NOT_FOUND {
+		log.Infof("Media of %s is no longer available on the phone", media.MessageID)
+		markMediaLost(media)
+		return
+	} else if err != nil {
+		log.Errorf("Failed to decrypt media retry notification for %s: %v", media.MessageID, err)
+		return
+	} else if notif.GetResult() != waProto.MediaRetryNotification_SUCCESS {
+		log.Errorf("Media retry for %s failed: %s", media.MessageID, notif.GetResult())
+		return
+	}
+
+	// The new path is saved first, so that the retry loop uses it if this download fails.
+	media.DirectPath = notif.GetDirectPath()
+	if err := setMediaDirectPath(media.MessageID, media.DirectPath); err != nil {
+		log.Errorf("Error saving direct path of media of %s: %v", media.MessageID, err)
+	}
+	if err := downloadMedia(media); err != nil {
+		// The retry loop will try again.
+		log.Errorf("Failed to download media of %s after retry: %v", media.MessageID, err)
+		return
+	}
+	notifyMediaStatus(media)
+}
+
+// Periodically attempt downloads of pending media whose retry is due.
+func mediaRetryLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !cli.IsConnected() {
+			continue
+		}
+		due, err := getDueMediaRetries(time.Now())
+		if err != nil {
+			log.Errorf("Error getting due media retries: %v", err)
+			continue
+		}
+		for i := range due {
+			media := &due[i]
+			if err := downloadMedia(media); err != nil {
+				log.Errorf("Failed to download media of %s: %v", media.MessageID, err)
+				requestMediaRetry(media, err)
+				continue
+			}
+			notifyMediaStatus(media)
+		}
+	}
+}
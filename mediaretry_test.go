@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMediaRetryWait(t *testing.T) {
+	now := time.Now()
+	future, past := now.Add(10*time.Minute), now.Add(-time.Minute)
+	tests := []struct {
+		name    string
+		retryAt *time.Time
+		min     time.Duration
+		max     time.Duration
+	}{
+		{name: "never failed", retryAt: nil, min: 0, max: 0},
+		{name: "retry scheduled", retryAt: &future, min: 9 * time.Minute, max: 10 * time.Minute},
+		{name: "retry due", retryAt: &past, min: time.Minute, max: time.Minute},
+	}
+	for _, tt := range tests {
+		wait := mediaRetryWait(&Media{Status: MediaPending, RetryAt: tt.retryAt})
+		if wait < tt.min || wait > tt.max {
+			t.Errorf("%s: mediaRetryWait() = %s, want between %s and %s", tt.name, wait, tt.min, tt.max)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrMediaNotFound is returned by MediaStore implementations when a key doesn't exist.
+var ErrMediaNotFound = errors.New("media not found")
+
+// MediaInfo describes a stored media file.
+type MediaInfo struct {
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+// MediaObject is an open stored media file.
+type MediaObject interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// MediaStore stores incoming and outgoing media files and their thumbnails by key.
+type MediaStore interface {
+	// Put stores size bytes read from r under key, replacing any existing file.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Open opens the file stored under key for reading.
+	Open(ctx context.Context, key string) (MediaObject, MediaInfo, error)
+	// Stat returns information about the file stored under key.
+	Stat(ctx context.Context, key string) (MediaInfo, error)
+	// Delete removes the file stored under key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+var mediaStore MediaStore // Media storage backend
+
+// Create the media store selected with the -media-store flag, encrypting files if encryption
+// keys are configured.
+func newMediaStore() (MediaStore, error) {
+	var store MediaStore
+	var err error
+	switch *mediaStoreType {
+	case "local":
+		store, err = newLocalMediaStore(*dirPtr)
+	case "s3":
+		store, err = newS3MediaStore(*s3Endpoint, *s3AccessKey, *s3SecretKey, *s3Bucket, *s3UseSSL)
+	default:
+		return nil, fmt.Errorf("unknown media store %q", *mediaStoreType)
+	}
+	if err != nil || !encryptionEnabled() {
+		return store, err
+	}
+	return &encryptedMediaStore{store}, nil
+}
+
+// Store a media file that is already in memory.
+func saveMedia(key string, data []byte, contentType string) error {
+	return mediaStore.Put(context.Background(), key, bytes.NewReader(data), int64(len(data)), contentType)
+}
+
+// Read a whole file from the media store.
+func readMedia(key string) ([]byte, error) {
+	obj, _, err := mediaStore.Open(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
+
+// Get the file extension to store media of the given mimetype with.
+func extensionForMimeType(mimeType string) string {
+	exts, _ := mime.ExtensionsByType(mimeType)
+	if len(exts) == 0 {
+		return ""
+	}
+	return exts[0]
+}
+
+// Get the storage key of the thumbnail of a message.
+func thumbnailKey(messageID string) string {
+	return messageID + ".jpg"
+}
+
+// Get the storage key of the thumbnail made from a blob.
+func blobThumbnailKey(sha256Hex string) string {
+	return "sha256/" + sha256Hex + ".thumb.jpg"
+}
+
+type localMediaStore struct {
+	root string
+}
+
+func newLocalMediaStore(root string) (*localMediaStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create media directory: %w", err)
+	}
+	return &localMediaStore{root: root}, nil
+}
+
+// Resolve a key to a path. Keys are cleaned as absolute paths so that they can't escape the root directory.
+func (s *localMediaStore) path(key string) (string, error) {
+	clean := filepath.Clean(string(filepath.Separator) + filepath.FromSlash(key))
+	if clean == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid media key %q", key)
+	}
+	return filepath.Join(s.root, clean), nil
+}
+
+func (s *localMediaStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that readers never see partial files.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localMediaStore) Open(ctx context.Context, key string) (MediaObject, MediaInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, MediaInfo{}, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, MediaInfo{}, ErrMediaNotFound
+	} else if err != nil {
+		return nil, MediaInfo{}, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, MediaInfo{}, err
+	}
+	return file, MediaInfo{Size: stat.Size(), ModTime: stat.ModTime(), ContentType: mime.TypeByExtension(filepath.Ext(path))}, nil
+}
+
+func (s *localMediaStore) Stat(ctx context.Context, key string) (MediaInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	stat, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return MediaInfo{}, ErrMediaNotFound
+	} else if err != nil {
+		return MediaInfo{}, err
+	}
+	return MediaInfo{Size: stat.Size(), ModTime: stat.ModTime(), ContentType: mime.TypeByExtension(filepath.Ext(path))}, nil
+}
+
+func (s *localMediaStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The chat log schema is created and upgraded by the SQL files in migrations/, which are
+// embedded in the binary. Files are named <version>_<name>.sql and applied in version order,
+// each in its own transaction, and applied versions are recorded in schema_migrations.
+// Migrations only create what doesn't exist yet, so they can be applied to hand-made schemas.
+//
+// Files starting with a "-- no-transaction" line are applied one statement at a time outside
+// of a transaction instead, as CREATE INDEX CONCURRENTLY requires. Their statements are split
+// at semicolons, so they can't contain semicolons otherwise, and they must be safe to apply
+// again, as they may be interrupted halfway.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Key of the advisory lock that serializes migrations of several instances.
+const migrationLockKey = 0x77617773 // "waws"
+
+// Header of migrations that are applied outside of a transaction.
+const noTransactionHeader = "-- no-transaction"
+
+// SQL that creates the table recording applied migrations.
+const createSchemaMigrations = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)
+`
+
+type migration struct {
+	Version       int
+	Name          string
+	SQL           string
+	NoTransaction bool
+}
+
+// Load the embedded migrations, ordered by version.
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]migration, 0, len(entries))
+	versions := make(map[int]string)
+	for _, entry := range entries {
+		prefix, _, ok := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+		if other, ok := versions[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, entry.Name())
+		}
+		versions[version] = entry.Name()
+		data, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{
+			Version:       version,
+			Name:          entry.Name(),
+			SQL:           string(data),
+			NoTransaction: strings.HasPrefix(string(data), noTransactionHeader+"\n"),
+		})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Get the versions of the migrations that were applied to the chat log database.
+func appliedMigrations() (map[int]bool, error) {
+	var exists bool
+	if err := db.QueryRow(`SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	applied := make(map[int]bool)
+	if !exists {
+		return applied, nil
+	}
+	rows, err := db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("%w", err)
+		}
+		applied[version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return applied, nil
+}
+
+// Apply a migration in a transaction, unless another instance applied it in the meantime.
+func applyMigration(m migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("%w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockKey); err != nil {
+		return false, fmt.Errorf("%w", err)
+	}
+	if _, err := tx.Exec(createSchemaMigrations); err != nil {
+		return false, fmt.Errorf("%w", err)
+	}
+	var applied bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.Version).Scan(&applied); err != nil {
+		return false, fmt.Errorf("%w", err)
+	} else if applied {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return false, fmt.Errorf("%s: %w", m.Name, err)
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name); err != nil {
+		return false, fmt.Errorf("%w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("%w", err)
+	}
+	return true, nil
+}
+
+// Split a migration into its statements, leaving out comments.
+func splitStatements(sql string) []string {
+	var lines []string
+	for _, line := range strings.Split(sql, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	var statements []string
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// Apply a migration one statement at a time outside of a transaction, unless another instance
+// applied it in the meantime. Other instances wait for it on a session-level advisory lock.
+func applyMigrationWithoutTransaction(m migration) (bool, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("%w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return false, fmt.Errorf("%w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey); err != nil {
+			log.Errorf("Failed to release migration lock: %v", err)
+		}
+	}()
+	if _, err := conn.ExecContext(ctx, createSchemaMigrations); err != nil {
+		return false, fmt.Errorf("%w", err)
+	}
+	var applied bool
+	if err := conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.Version).Scan(&applied); err != nil {
+		return false, fmt.Errorf("%w", err)
+	} else if applied {
+		return false, nil
+	}
+
+	for _, statement := range splitStatements(m.SQL) {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return false, fmt.Errorf("%s: %w", m.Name, err)
+		}
+	}
+	if _, err := conn.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name); err != nil {
+		return false, fmt.Errorf("%w", err)
+	}
+	return true, nil
+}
+
+// Apply the pending migrations to the chat log database and return them. In a dry run, the
+// pending migrations are only returned.
+func migrateDB(dryRun bool) ([]migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
+	}
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	if dryRun {
+		return pending, nil
+	}
+
+	for i, m := range pending {
+		apply := applyMigration
+		if m.NoTransaction {
+			apply = applyMigrationWithoutTransaction
+		}
+		ok, err := apply(m)
+		if err != nil {
+			return pending[:i], fmt.Errorf("failed to apply migration %s: %w", m.Name, err)
+		}
+		if ok {
+			log.Infof("Applied migration %s", m.Name)
+		}
+	}
+	return pending, nil
+}
+
+// Run the migrate subcommand, which applies the pending migrations and exits. With dry-run,
+// the pending migrations are printed instead.
+func runMigrateCommand(args []string) int {
+	dryRun := len(args) > 0 && args[0] == "dry-run"
+
+	var err error
+	db, err = sql.Open("postgres", *chatLogDBAddress)
+	if err != nil {
+		log.Errorf("Failed to connect chatlog database: %v", err)
+		return 1
+	}
+	defer db.Close()
+
+	pending, err := migrateDB(dryRun)
+	if err != nil {
+		log.Errorf("%v", err)
+		return 1
+	}
+	if len(pending) == 0 {
+		log.Infof("Chat log database is up to date")
+	} else if dryRun {
+		for _, m := range pending {
+			fmt.Printf("-- %s\n%s\n", m.Name, m.SQL)
+		}
+		log.Infof("%d pending migrations", len(pending))
+	}
+	return 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations")
+	}
+	for i, m := range migrations {
+		if i > 0 && m.Version <= migrations[i-1].Version {
+			t.Errorf("%s is ordered after %s", m.Name, migrations[i-1].Name)
+		}
+		if strings.TrimSpace(m.SQL) == "" {
+			t.Errorf("%s is empty", m.Name)
+		}
+		// Plain CREATE INDEX blocks writes to the table while the index is built.
+		for _, statement := range splitStatements(m.SQL) {
+			if strings.HasPrefix(statement, "CREATE INDEX") && (!m.NoTransaction || !strings.HasPrefix(statement, "CREATE INDEX CONCURRENTLY")) {
+				t.Errorf("%s: index isn't built concurrently: %s", m.Name, statement)
+			}
+		}
+	}
+}
+
+// Every column of the media tables is also added to existing tables, so that hand-made tables
+// are upgraded.
+func TestMediaMigrationAddsColumns(t *testing.T) {
+	data, err := migrationFiles.ReadFile("migrations/0005_media.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sql := string(data)
+	tables := regexp.MustCompile(`(?s)CREATE TABLE IF NOT EXISTS (\w+) \((.*?)\n\);`).FindAllStringSubmatch(sql, -1)
+	if len(tables) != 3 {
+		t.Fatalf("found %d tables, want 3", len(tables))
+	}
+	for _, table := range tables {
+		for _, line := range strings.Split(strings.TrimSpace(table[2]), "\n") {
+			column := strings.TrimSuffix(strings.TrimSpace(line), ",")
+			// Keys, and other columns without a default, can't be added to tables with rows.
+			if strings.Contains(column, "PRIMARY KEY") || strings.Contains(column, "NOT NULL") && !strings.Contains(column, "DEFAULT") {
+				continue
+			}
+			if alter := "ALTER TABLE " + table[1] + " ADD COLUMN IF NOT EXISTS " + column + ";"; !strings.Contains(sql, alter) {
+				t.Errorf("missing %s", alter)
+			}
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	sql := "-- no-transaction\n-- A comment; with a semicolon\n\nCREATE INDEX a ON b (c);\nCREATE INDEX d\n\tON e (f);\n"
+	want := []string{"CREATE INDEX a ON b (c)", "CREATE INDEX d\n\tON e (f)"}
+	if got := splitStatements(sql); !reflect.DeepEqual(got, want) {
+		t.Errorf("splitStatements() = %q, want %q", got, want)
+	}
+}
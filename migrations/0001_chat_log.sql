@@ -0,0 +1,38 @@
+-- Messages and the last message of every chat. Columns that were added over time are also
+-- added to existing tables, so that hand-made schemas are upgraded as well.
+
+CREATE TABLE IF NOT EXISTS messages (
+	message_id text NOT NULL,
+	device_jid text NOT NULL DEFAULT '',
+	remote_jid text NOT NULL,
+	type text NOT NULL DEFAULT '',
+	content text NOT NULL DEFAULT '',
+	timestamp timestamptz NOT NULL,
+	sent boolean NOT NULL DEFAULT false,
+	file_name text NOT NULL DEFAULT ''
+);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS user_id integer;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS read_at timestamptz;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS sender_jid text NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS push_name text NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS flagged boolean NOT NULL DEFAULT false;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS flag_reason text NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS content_key text NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS last_messages (
+	message_id text NOT NULL,
+	device_jid text NOT NULL DEFAULT '',
+	remote_jid text PRIMARY KEY,
+	type text NOT NULL DEFAULT '',
+	content text NOT NULL DEFAULT '',
+	timestamp timestamptz NOT NULL,
+	sent boolean NOT NULL DEFAULT false,
+	file_name text NOT NULL DEFAULT ''
+);
+
+ALTER TABLE last_messages ADD COLUMN IF NOT EXISTS user_id integer;
+ALTER TABLE last_messages ADD COLUMN IF NOT EXISTS read_at timestamptz;
+ALTER TABLE last_messages ADD COLUMN IF NOT EXISTS sender_jid text NOT NULL DEFAULT '';
+ALTER TABLE last_messages ADD COLUMN IF NOT EXISTS push_name text NOT NULL DEFAULT '';
+ALTER TABLE last_messages ADD COLUMN IF NOT EXISTS content_key text NOT NULL DEFAULT '';
@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS groups (
+	group_jid text PRIMARY KEY,
+	device_jid text NOT NULL DEFAULT '',
+	name text NOT NULL DEFAULT '',
+	topic text NOT NULL DEFAULT '',
+	owner_jid text NOT NULL DEFAULT '',
+	created_at timestamptz,
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS group_participants (
+	group_jid text NOT NULL,
+	participant_jid text NOT NULL,
+	is_admin boolean NOT NULL DEFAULT false,
+	is_super_admin boolean NOT NULL DEFAULT false,
+	PRIMARY KEY (group_jid, participant_jid)
+);
+
+CREATE TABLE IF NOT EXISTS group_invites (
+	message_id text PRIMARY KEY,
+	device_jid text NOT NULL DEFAULT '',
+	remote_jid text NOT NULL DEFAULT '',
+	group_jid text NOT NULL DEFAULT '',
+	group_name text NOT NULL DEFAULT '',
+	inviter_jid text NOT NULL DEFAULT '',
+	code text NOT NULL DEFAULT '',
+	expiration bigint NOT NULL DEFAULT 0,
+	accepted_at timestamptz
+);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS statuses (
+	message_id text PRIMARY KEY,
+	device_jid text NOT NULL DEFAULT '',
+	sender_jid text NOT NULL DEFAULT '',
+	push_name text NOT NULL DEFAULT '',
+	type text NOT NULL DEFAULT '',
+	content text NOT NULL DEFAULT '',
+	content_key text NOT NULL DEFAULT '',
+	file_name text NOT NULL DEFAULT '',
+	timestamp timestamptz NOT NULL,
+	expires_at timestamptz NOT NULL
+);
+
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS contacts (
+	jid text PRIMARY KEY,
+	device_jid text NOT NULL DEFAULT '',
+	first_name text NOT NULL DEFAULT '',
+	full_name text NOT NULL DEFAULT '',
+	push_name text NOT NULL DEFAULT '',
+	business_name text NOT NULL DEFAULT '',
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS avatars (
+	jid text PRIMARY KEY,
+	picture_id text NOT NULL DEFAULT '',
+	storage_key text NOT NULL DEFAULT '',
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS number_checks (
+	query text PRIMARY KEY,
+	is_in boolean NOT NULL DEFAULT false,
+	jid text NOT NULL DEFAULT '',
+	verified_name text NOT NULL DEFAULT '',
+	checked_at timestamptz NOT NULL
+);
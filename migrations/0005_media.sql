@@ -0,0 +1,87 @@
+-- Media of messages. Files are stored once per content in media_blobs, and uploads to WhatsApp
+-- are remembered in media_uploads so that they can be reused. Columns are also added to existing
+-- tables, so that hand-made schemas are upgraded as well. The sha256 column of media is the hash
+-- of the stored file, only set once it is downloaded, and file_sha256 the hash in the message,
+-- which is used to verify downloads.
+
+CREATE TABLE IF NOT EXISTS media (
+	message_id text PRIMARY KEY,
+	device_jid text NOT NULL DEFAULT '',
+	remote_jid text NOT NULL DEFAULT '',
+	storage_key text NOT NULL DEFAULT '',
+	thumbnail_key text NOT NULL DEFAULT '',
+	sha256 text,
+	mimetype text NOT NULL DEFAULT '',
+	file_name text NOT NULL DEFAULT '',
+	size bigint NOT NULL DEFAULT 0,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	status text NOT NULL DEFAULT 'available',
+	retry_count integer NOT NULL DEFAULT 0,
+	retry_at timestamptz,
+	sender_jid text NOT NULL DEFAULT '',
+	from_me boolean NOT NULL DEFAULT false,
+	media_type text NOT NULL DEFAULT '',
+	direct_path text NOT NULL DEFAULT '',
+	media_key bytea,
+	file_enc_sha256 bytea,
+	file_sha256 bytea,
+	scan_result text NOT NULL DEFAULT '',
+	scan_attempts integer NOT NULL DEFAULT 0
+);
+
+ALTER TABLE media ADD COLUMN IF NOT EXISTS device_jid text NOT NULL DEFAULT '';
+ALTER TABLE media ADD COLUMN IF NOT EXISTS remote_jid text NOT NULL DEFAULT '';
+ALTER TABLE media ADD COLUMN IF NOT EXISTS storage_key text NOT NULL DEFAULT '';
+ALTER TABLE media ADD COLUMN IF NOT EXISTS thumbnail_key text NOT NULL DEFAULT '';
+ALTER TABLE media ADD COLUMN IF NOT EXISTS sha256 text;
+ALTER TABLE media ADD COLUMN IF NOT EXISTS mimetype text NOT NULL DEFAULT '';
+ALTER TABLE media ADD COLUMN IF NOT EXISTS file_name text NOT NULL DEFAULT '';
+ALTER TABLE media ADD COLUMN IF NOT EXISTS size bigint NOT NULL DEFAULT 0;
+ALTER TABLE media ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE media ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'available';
+ALTER TABLE media ADD COLUMN IF NOT EXISTS retry_count integer NOT NULL DEFAULT 0;
+ALTER TABLE media ADD COLUMN IF NOT EXISTS retry_at timestamptz;
+ALTER TABLE media ADD COLUMN IF NOT EXISTS sender_jid text NOT NULL DEFAULT '';
+ALTER TABLE media ADD COLUMN IF NOT EXISTS from_me boolean NOT NULL DEFAULT false;
+ALTER TABLE media ADD COLUMN IF NOT EXISTS media_type text NOT NULL DEFAULT '';
+ALTER TABLE media ADD COLUMN IF NOT EXISTS direct_path text NOT NULL DEFAULT '';
+ALTER TABLE media ADD COLUMN IF NOT EXISTS media_key bytea;
+ALTER TABLE media ADD COLUMN IF NOT EXISTS file_enc_sha256 bytea;
+ALTER TABLE media ADD COLUMN IF NOT EXISTS file_sha256 bytea;
+ALTER TABLE media ADD COLUMN IF NOT EXISTS scan_result text NOT NULL DEFAULT '';
+ALTER TABLE media ADD COLUMN IF NOT EXISTS scan_attempts integer NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS media_blobs (
+	sha256 text PRIMARY KEY,
+	storage_key text NOT NULL,
+	mimetype text NOT NULL DEFAULT '',
+	size bigint NOT NULL DEFAULT 0,
+	ref_count integer NOT NULL DEFAULT 0,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+
+ALTER TABLE media_blobs ADD COLUMN IF NOT EXISTS mimetype text NOT NULL DEFAULT '';
+ALTER TABLE media_blobs ADD COLUMN IF NOT EXISTS size bigint NOT NULL DEFAULT 0;
+ALTER TABLE media_blobs ADD COLUMN IF NOT EXISTS ref_count integer NOT NULL DEFAULT 0;
+ALTER TABLE media_blobs ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now();
+
+CREATE TABLE IF NOT EXISTS media_uploads (
+	sha256 text NOT NULL,
+	media_type text NOT NULL,
+	url text NOT NULL DEFAULT '',
+	direct_path text NOT NULL DEFAULT '',
+	media_key bytea,
+	file_enc_sha256 bytea,
+	file_sha256 bytea,
+	file_length bigint NOT NULL DEFAULT 0,
+	uploaded_at timestamptz NOT NULL,
+	PRIMARY KEY (sha256, media_type)
+);
+
+ALTER TABLE media_uploads ADD COLUMN IF NOT EXISTS url text NOT NULL DEFAULT '';
+ALTER TABLE media_uploads ADD COLUMN IF NOT EXISTS direct_path text NOT NULL DEFAULT '';
+ALTER TABLE media_uploads ADD COLUMN IF NOT EXISTS media_key bytea;
+ALTER TABLE media_uploads ADD COLUMN IF NOT EXISTS file_enc_sha256 bytea;
+ALTER TABLE media_uploads ADD COLUMN IF NOT EXISTS file_sha256 bytea;
+ALTER TABLE media_uploads ADD COLUMN IF NOT EXISTS file_length bigint NOT NULL DEFAULT 0;
+ALTER TABLE media_uploads ADD COLUMN IF NOT EXISTS uploaded_at timestamptz NOT NULL DEFAULT now();
@@ -0,0 +1,10 @@
+-- no-transaction
+-- Indexes are built concurrently, so that building them on large existing tables doesn't block
+-- writes. If building an index fails, Postgres leaves it invalid, and it has to be dropped
+-- before the migration is applied again.
+
+CREATE INDEX CONCURRENTLY IF NOT EXISTS messages_message_id_idx ON messages (message_id);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS messages_remote_jid_timestamp_idx ON messages (remote_jid, timestamp DESC);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS statuses_expires_at_idx ON statuses (expires_at);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS media_sha256_idx ON media (sha256);
+CREATE INDEX CONCURRENTLY IF NOT EXISTS media_status_retry_at_idx ON media (status, retry_at);
@@ -2,28 +2,84 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"io"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
-// WIP
-func UploadFile(endpoint, accessKey, secretKey, bucket, objectName, filePath string) error {
+// s3MediaStore stores media in a bucket of an S3 compatible service such as MinIO.
+type s3MediaStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3MediaStore(endpoint, accessKey, secretKey, bucket string, useSSL bool) (*s3MediaStore, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, fmt.Errorf("-s3-endpoint and -s3-bucket are required for the s3 media store")
+	}
+
 	// Initialize MinIO client object.
 	minioClient, err := minio.New(endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
-		Secure: true,
+		Secure: useSSL,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Upload the file with FPutObject
-	_, err = minioClient.FPutObject(context.Background(), bucket, objectName, filePath, minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	exists, err := minioClient.BucketExists(context.Background(), bucket)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to check bucket %s: %w", bucket, err)
+	} else if !exists {
+		return nil, fmt.Errorf("bucket %s does not exist", bucket)
 	}
 
-	log.Infof("Successfully uploaded %s to %s\n", filePath, objectName)
+	return &s3MediaStore{client: minioClient, bucket: bucket}, nil
+}
+
+func (s *s3MediaStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return err
+	}
+	log.Debugf("Uploaded %s to bucket %s", key, s.bucket)
 	return nil
 }
+
+func (s *s3MediaStore) Open(ctx context.Context, key string) (MediaObject, MediaInfo, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, MediaInfo{}, s.convertError(err)
+	}
+	// GetObject doesn't contact the server until the object is used.
+	stat, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, MediaInfo{}, s.convertError(err)
+	}
+	return obj, MediaInfo{Size: stat.Size, ModTime: stat.LastModified, ContentType: stat.ContentType}, nil
+}
+
+func (s *s3MediaStore) Stat(ctx context.Context, key string) (MediaInfo, error) {
+	stat, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return MediaInfo{}, s.convertError(err)
+	}
+	return MediaInfo{Size: stat.Size, ModTime: stat.LastModified, ContentType: stat.ContentType}, nil
+}
+
+func (s *s3MediaStore) Delete(ctx context.Context, key string) error {
+	return s.convertError(s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}))
+}
+
+func (s *s3MediaStore) convertError(err error) error {
+	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrMediaNotFound
+	}
+	return err
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal S3 compatible server with a single bucket, supporting the requests the
+// s3 media store makes.
+type fakeS3 struct {
+	bucket  string
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+}
+
+type fakeS3Object struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+func newFakeS3(t *testing.T, bucket string) *httptest.Server {
+	s3 := &fakeS3{bucket: bucket, objects: make(map[string]fakeS3Object)}
+	server := httptest.NewServer(s3)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		s.writeError(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if key == "" {
+		if r.URL.Query().Has("location") {
+			fmt.Fprint(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+		}
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			s.writeError(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = fakeS3Object{data: data, contentType: r.Header.Get("Content-Type"), modTime: time.Now().Truncate(time.Second)}
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(data))+`"`)
+	case http.MethodGet, http.MethodHead:
+		obj, ok := s.objects[key]
+		if !ok {
+			s.writeError(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(obj.data))+`"`)
+		http.ServeContent(w, r, key, obj.modTime, bytes.NewReader(obj.data))
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3) writeError(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+	}
+}
+
+// Read the body of a PUT request, which is sent in signed chunks over plain HTTP.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var data []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		chunk := make([]byte, size+2) // The chunk and its CRLF
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func newTestS3MediaStore(t *testing.T) *s3MediaStore {
+	server := newFakeS3(t, "media")
+	store, err := newS3MediaStore(strings.TrimPrefix(server.URL, "http://"), "access", "secret", "media", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestS3MediaStore(t *testing.T) {
+	store := newTestS3MediaStore(t)
+	ctx := context.Background()
+
+	if _, err := store.Stat(ctx, "missing.jpg"); !errors.Is(err, ErrMediaNotFound) {
+		t.Errorf("Stat of a missing file: error = %v, want ErrMediaNotFound", err)
+	}
+	if _, _, err := store.Open(ctx, "missing.jpg"); !errors.Is(err, ErrMediaNotFound) {
+		t.Errorf("Open of a missing file: error = %v, want ErrMediaNotFound", err)
+	}
+
+	data := []byte("0123456789abcdef")
+	if err := store.Put(ctx, "sha256/abc.jpg", bytes.NewReader(data), int64(len(data)), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := store.Stat(ctx, "sha256/abc.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) || info.ContentType != "image/jpeg" || info.ModTime.IsZero() {
+		t.Errorf("Stat() = %+v", info)
+	}
+
+	obj, info, err := store.Open(ctx, "sha256/abc.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Errorf("Open() size = %d, want %d", info.Size, len(data))
+	}
+	if _, err := obj.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(obj)
+	obj.Close()
+	if err != nil || string(rest) != "abcdef" {
+		t.Errorf("read %q, %v after seeking, want %q", rest, err, "abcdef")
+	}
+
+	if err := store.Delete(ctx, "sha256/abc.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(ctx, "sha256/abc.jpg"); !errors.Is(err, ErrMediaNotFound) {
+		t.Errorf("Stat of a deleted file: error = %v, want ErrMediaNotFound", err)
+	}
+	if err := store.Delete(ctx, "sha256/abc.jpg"); err != nil {
+		t.Errorf("Delete of a missing file: %v", err)
+	}
+}
+
+func TestS3MediaStoreRequiresBucket(t *testing.T) {
+	server := newFakeS3(t, "media")
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+	if _, err := newS3MediaStore(endpoint, "access", "secret", "other", false); err == nil {
+		t.Error("store was created for a missing bucket")
+	}
+	if _, err := newS3MediaStore(endpoint, "access", "secret", "", false); err == nil {
+		t.Error("store was created without a bucket")
+	}
+}
+
+// Encrypted files are read in segments with range requests.
+func TestEncryptedS3MediaStore(t *testing.T) {
+	useTestKeys(t, randomBytes(t, 32))
+	store := &encryptedMediaStore{MediaStore: newTestS3MediaStore(t)}
+	ctx := context.Background()
+
+	data := randomBytes(t, 3*streamSegmentSize+5)
+	if err := store.Put(ctx, "file", bytes.NewReader(data), int64(len(data)), "video/mp4"); err != nil {
+		t.Fatal(err)
+	}
+	obj, info, err := store.Open(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if info.Size != int64(len(data)) {
+		t.Errorf("size = %d, want %d", info.Size, len(data))
+	}
+	offset := int64(2*streamSegmentSize + 3)
+	if _, err := obj.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, data[offset:]) {
+		t.Error("read wrong data after seeking")
+	}
+}
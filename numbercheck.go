@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Check whether phone numbers are on WhatsApp. Results younger than the configured TTL are
+// served from the database, the rest are queried in batches with a delay between them.
+// The returned results are in the same order as the queries, with numbers that can't be
+// normalized or checked reported through the Error field. When a batch fails, the error is
+// recorded on each of its numbers and the other batches are still checked.
+func checkNumbers(queries []string) []NumberCheck {
+	keys := make([]string, 0, len(queries))
+	seen := make(map[string]struct{}, len(queries))
+	results := make(map[string]NumberCheck, len(queries))
+	for _, query := range queries {
+		key, err := normalizePhoneNumber(query)
+		if err != nil {
+			key = query
+			results[key] = NumberCheck{Query: query, Error: err.Error()}
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+
+	cached, err := getNumberChecks(keys, time.Now().Add(-*checkUserTTL))
+	if err != nil {
+		log.Warnf("Failed to get cached number checks: %v", err)
+	}
+	for _, check := range cached {
+		results[check.Query] = check
+	}
+
+	var missing []string
+	for _, key := range keys {
+		if _, ok := results[key]; !ok {
+			missing = append(missing, "+"+key)
+		}
+	}
+
+	batchSize := *checkUserBatchSize
+	if batchSize <= 0 {
+		batchSize = len(missing)
+	}
+	for start := 0; start < len(missing); start += batchSize {
+		if start > 0 {
+			time.Sleep(*checkUserBatchDelay)
+		}
+		end := start + batchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+
+		log.Infof("Checking %d numbers on WhatsApp (%d/%d)", end-start, end, len(missing))
+		resp, err := cli.IsOnWhatsApp(missing[start:end])
+		if err != nil {
+			log.Errorf("Failed to check %d numbers on WhatsApp: %v", end-start, err)
+			for _, query := range missing[start:end] {
+				key := strings.TrimPrefix(query, "+")
+				results[key] = NumberCheck{Query: key, Error: fmt.Sprintf("failed to check if user is on WhatsApp: %v", err)}
+			}
+			continue
+		}
+
+		now := time.Now()
+		for _, item := range resp {
+			check := NumberCheck{
+				Query:     strings.TrimPrefix(item.Query, "+"),
+				IsIn:      item.IsIn,
+				JID:       item.JID.String(),
+				CheckedAt: now,
+			}
+			if item.VerifiedName != nil {
+				check.VerifiedName = item.VerifiedName.Details.GetVerifiedName()
+			}
+			if err := upsertNumberCheck(check); err != nil {
+				log.Errorf("Error upserting number check: %v", err)
+			}
+			results[check.Query] = check
+		}
+	}
+
+	checks := make([]NumberCheck, 0, len(keys))
+	for _, key := range keys {
+		check, ok := results[key]
+		if !ok {
+			check = NumberCheck{Query: key, Error: "no result from WhatsApp"}
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+func handleCheckUser(args []string) {
+	log.Infof("Checking users: %v", args)
+	if len(args) < 1 {
+		log.Errorf("Usage: checkuser <phone numbers...>")
+		sendReply("checkuser", nil, fmt.Errorf("usage: checkuser <phone numbers...>"))
+		return
+	}
+
+	// Checking many numbers takes a while because of the delay between batches, so it doesn't
+	// hold up other commands.
+	go func() {
+		checks := checkNumbers(args)
+		for _, check := range checks {
+			if check.Error != "" {
+				log.Warnf("%s: %s", check.Query, check.Error)
+				continue
+			}
+			logMessage := fmt.Sprintf("%s: on WhatsApp: %t, JID: %s", check.Query, check.IsIn, check.JID)
+			if check.VerifiedName != "" {
+				logMessage += fmt.Sprintf(", business name: %s", check.VerifiedName)
+			}
+			log.Infof(logMessage)
+		}
+
+		sendReply("checkuser", checks, nil)
+	}()
+}
+
+// ServeCheckUser checks the phone numbers given in the numbers parameter, separated by commas,
+// semicolons or newlines. The results are returned as JSON, or as CSV with format=csv.
+func serveCheckUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var queries []string
+	for _, query := range strings.FieldsFunc(r.FormValue("numbers"), func(r rune) bool {
+		return r == ',' || r == ';' || r == '\n' || r == '\r'
+	}) {
+		if query = strings.TrimSpace(query); query != "" {
+			queries = append(queries, query)
+		}
+	}
+	if len(queries) == 0 {
+		http.Error(w, "No phone numbers given", http.StatusBadRequest)
+		return
+	}
+
+	checks := checkNumbers(queries)
+	if r.FormValue("format") != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(checks); err != nil {
+			log.Errorf("Failed to write checkuser response: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="checkuser.csv"`)
+	csvWriter := csv.NewWriter(w)
+	_ = csvWriter.Write([]string{"query", "is_in", "jid", "verified_name", "checked_at", "error"})
+	for _, check := range checks {
+		var checkedAt string
+		if !check.CheckedAt.IsZero() {
+			checkedAt = check.CheckedAt.Format(time.RFC3339)
+		}
+		_ = csvWriter.Write([]string{check.Query, strconv.FormatBool(check.IsIn), check.JID, check.VerifiedName, checkedAt, check.Error})
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		log.Errorf("Failed to write checkuser response: %v", err)
+	}
+}
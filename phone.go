@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// E.164 numbers have at most 15 digits including the country code. The lower
+// bound rules out obviously truncated input while still allowing short numbering plans.
+const (
+	minPhoneDigits = 8
+	maxPhoneDigits = 15
+)
+
+// Normalize a phone number as typed by a person into E.164 digits without the leading +.
+//
+// Spaces, dashes, dots and parentheses are removed. Numbers starting with + or the 00
+// international prefix are taken as-is. Numbers starting with a single 0 national trunk
+// prefix, and numbers no longer than -national-number-length, are national numbers and get
+// the default country code prepended. Longer numbers already include a country code.
+func normalizePhoneNumber(raw string) (string, error) {
+	number := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r), r == '-', r == '.', r == '(', r == ')', r == '/':
+			return -1
+		}
+		return r
+	}, raw)
+	if number == "" {
+		return "", fmt.Errorf("empty phone number")
+	}
+
+	international := false
+	switch {
+	case strings.HasPrefix(number, "+"):
+		number = number[1:]
+		international = true
+	case strings.HasPrefix(number, "00"):
+		number = number[2:]
+		international = true
+	}
+
+	for _, r := range number {
+		if r < '0' || r > '9' {
+			return "", fmt.Errorf("invalid phone number %q: unexpected character %q", raw, r)
+		}
+	}
+
+	if !international {
+		countryCode := strings.TrimPrefix(*defaultCountryCode, "+")
+		switch {
+		case strings.HasPrefix(number, "0"):
+			number = countryCode + number[1:]
+		case len(number) <= *nationalNumberLength:
+			number = countryCode + number
+		}
+	}
+
+	if strings.HasPrefix(number, "0") {
+		return "", fmt.Errorf("invalid phone number %q: country code can't start with 0", raw)
+	} else if len(number) < minPhoneDigits {
+		return "", fmt.Errorf("invalid phone number %q: too short, expected at least %d digits including country code", raw, minPhoneDigits)
+	} else if len(number) > maxPhoneDigits {
+		return "", fmt.Errorf("invalid phone number %q: too long, expected at most %d digits including country code", raw, maxPhoneDigits)
+	}
+	return number, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestNormalizePhoneNumber(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "+49 151 23456789", want: "4915123456789"},
+		{raw: "0049 151 23456789", want: "4915123456789"},
+		{raw: "4915123456789", want: "4915123456789"},
+		{raw: "0532 123 45 67", want: "905321234567"},
+		{raw: "5321234567", want: "905321234567"},
+		{raw: "(532) 123-45-67", want: "905321234567"},
+		{raw: "905321234567", want: "905321234567"},
+		{raw: "+90 532 123 45 67", want: "905321234567"},
+		{raw: "", wantErr: true},
+		{raw: "+49 151 abc", wantErr: true},
+		{raw: "+0532 123 45 67", wantErr: true},
+		{raw: "+1234", wantErr: true},
+		{raw: "+49 151 2345 6789 0123", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizePhoneNumber(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizePhoneNumber(%q) = %q, want error", tt.raw, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizePhoneNumber(%q) returned error: %v", tt.raw, err)
+		} else if got != tt.want {
+			t.Errorf("normalizePhoneNumber(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParseJID(t *testing.T) {
+	tests := []struct {
+		arg     string
+		want    string
+		wantErr bool
+	}{
+		{arg: "0532 123 45 67", want: "905321234567@s.whatsapp.net"},
+		{arg: " +49 151 23456789 ", want: "4915123456789@s.whatsapp.net"},
+		{arg: "905321234567@s.whatsapp.net", want: "905321234567@s.whatsapp.net"},
+		{arg: "120363025246125486@g.us", want: "120363025246125486@g.us"},
+		{arg: "", wantErr: true},
+		{arg: "   ", wantErr: true},
+		{arg: "@s.whatsapp.net", wantErr: true},
+		{arg: "not a number", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseJID(tt.arg)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseJID(%q) = %s, want error", tt.arg, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseJID(%q) returned error: %v", tt.arg, err)
+		} else if got.String() != tt.want {
+			t.Errorf("parseJID(%q) = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// RetentionPolicy decides which stored media files are purged. Files are purged when they are
+// older than the maximum age for their chat, their media type or all media, in that order of
+// precedence, and the oldest remaining files are purged while the stored media exceeds the
+// disk budget. Zero durations and budgets are not enforced.
+type RetentionPolicy struct {
+	MaxAge     time.Duration
+	TypeMaxAge map[string]time.Duration
+	ChatMaxAge map[string]time.Duration
+	DiskBudget int64
+}
+
+// GCReport describes the media purged by a garbage collection run.
+type GCReport struct {
+	DryRun         bool      `json:"dry_run"`
+	Purged         int       `json:"purged"`
+	ReclaimedBytes int64     `json:"reclaimed_bytes"`
+	StoredBytes    int64     `json:"stored_bytes"`
+	StartedAt      time.Time `json:"started_at"`
+	Duration       string    `json:"duration"`
+}
+
+// Parse a comma separated list of key=duration pairs.
+func parseDurationMap(value string, parseKey func(string) (string, error)) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for _, item := range splitList(value) {
+		key, durationStr, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid retention rule %q, expected key=duration", item)
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(durationStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention rule %q: %w", item, err)
+		}
+		if key, err = parseKey(strings.TrimSpace(key)); err != nil {
+			return nil, fmt.Errorf("invalid retention rule %q: %w", item, err)
+		}
+		durations[key] = duration
+	}
+	return durations, nil
+}
+
+// Build the retention policy from the -retention-* flags.
+func parseRetentionPolicy() (RetentionPolicy, error) {
+	policy := RetentionPolicy{MaxAge: *retentionMaxAge, DiskBudget: *retentionDiskBudget}
+	var err error
+	policy.TypeMaxAge, err = parseDurationMap(*retentionTypes, func(key string) (string, error) {
+		if _, ok := mediaTypes[key]; !ok {
+			return "", fmt.Errorf("unknown media type %q", key)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return policy, err
+	}
+	policy.ChatMaxAge, err = parseDurationMap(*retentionChats, func(key string) (string, error) {
+		jid, err := types.ParseJID(key)
+		if err != nil {
+			return "", err
+		}
+		return jid.ToNonAD().String(), nil
+	})
+	return policy, err
+}
+
+// Check if the policy enforces anything at all.
+func (p RetentionPolicy) enabled() bool {
+	return p.MaxAge > 0 || len(p.TypeMaxAge) > 0 || len(p.ChatMaxAge) > 0 || p.DiskBudget > 0
+}
+
+// Get the maximum age of a media file, or zero if it may be kept forever.
+func (p RetentionPolicy) maxAge(media Media) time.Duration {
+	if maxAge, ok := p.ChatMaxAge[media.RemoteJID]; ok {
+		return maxAge
+	}
+	if maxAge, ok := p.TypeMaxAge[media.MediaType]; ok {
+		return maxAge
+	}
+	return p.MaxAge
+}
+
+// Purge the stored media files selected by the retention policy. In a dry run, nothing is
+// purged and the report describes what would have been purged. As files are shared between
+// messages, space is only reclaimed once no remaining message references a file. Thumbnails
+// are deleted along with their files, and as they are small, they don't count toward the disk
+// budget.
+func collectMedia(policy RetentionPolicy, dryRun bool) (*GCReport, error) {
+	report := &GCReport{DryRun: dryRun, StartedAt: time.Now()}
+
+	stored, err := listStoredMedia()
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := listMediaBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	// Count stored bytes and references per file, as files without a hash aren't shared.
+	refs := make(map[string]int)
+	for _, blob := range blobs {
+		report.StoredBytes += blob.Size
+		refs[blob.StorageKey] = blob.RefCount
+	}
+	for _, media := range stored {
+		if media.SHA256 == "" {
+			report.StoredBytes += media.Size
+			refs[media.StorageKey]++
+		}
+	}
+
+	var purge []Media
+	selected := make([]bool, len(stored))
+	remaining := report.StoredBytes
+	release := func(i int) {
+		media := stored[i]
+		selected[i] = true
+		purge = append(purge, media)
+		if refs[media.StorageKey]--; refs[media.StorageKey] <= 0 {
+			size := media.Size
+			if blob, ok := blobs[media.SHA256]; ok {
+				size = blob.Size
+			}
+			report.ReclaimedBytes += size
+			remaining -= size
+		}
+	}
+
+	for i, media := range stored {
+		if maxAge := policy.maxAge(media); maxAge > 0 && report.StartedAt.Sub(media.CreatedAt) > maxAge {
+			release(i)
+		}
+	}
+	if policy.DiskBudget > 0 {
+		for i := range stored {
+			if remaining <= policy.DiskBudget {
+				break
+			}
+			if !selected[i] {
+				release(i)
+			}
+		}
+	}
+	report.Purged = len(purge)
+
+	if !dryRun {
+		for _, media := range purge {
+			deleteKeys, err := purgeMedia(media)
+			if err != nil {
+				return nil, fmt.Errorf("failed to purge media of %s: %w", media.MessageID, err)
+			}
+			for _, key := range deleteKeys {
+				if err := mediaStore.Delete(context.Background(), key); err != nil && !errors.Is(err, ErrMediaNotFound) {
+					log.Errorf("Error deleting media file %s: %v", key, err)
+				}
+			}
+		}
+	}
+
+	report.Duration = time.Since(report.StartedAt).String()
+	log.Infof("Media garbage collection (dry run: %t) purged %d files, reclaiming %d of %d bytes", dryRun, report.Purged, report.ReclaimedBytes, report.StoredBytes)
+	return report, nil
+}
+
+// Periodically purge media according to the retention policy.
+func mediaRetentionLoop(policy RetentionPolicy) {
+	ticker := time.NewTicker(*retentionInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := collectMedia(policy, *retentionDryRun); err != nil {
+			log.Errorf("Error collecting media: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+func handleGCMedia(args []string) {
+	dryRun := argAt(args, 0) == "dry-run"
+	if len(args) > 0 && !dryRun {
+		log.Errorf("Usage: gcmedia [dry-run]")
+		sendReply("gcmedia", nil, fmt.Errorf("usage: gcmedia [dry-run]"))
+		return
+	}
+
+	policy, err := parseRetentionPolicy()
+	if err != nil {
+		log.Errorf("Invalid retention policy: %v", err)
+		sendReply("gcmedia", nil, err)
+		return
+	}
+	if !policy.enabled() {
+		sendReply("gcmedia", nil, fmt.Errorf("no retention policy configured"))
+		return
+	}
+
+	report, err := collectMedia(policy, dryRun || *retentionDryRun)
+	if err != nil {
+		log.Errorf("Error collecting media: %v", err)
+		sendReply("gcmedia", nil, err)
+		return
+	}
+	sendReply("gcmedia", report, nil)
+}
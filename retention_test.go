@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	oldMaxAge, oldTypes, oldChats, oldBudget := *retentionMaxAge, *retentionTypes, *retentionChats, *retentionDiskBudget
+	defer func() {
+		*retentionMaxAge, *retentionTypes, *retentionChats, *retentionDiskBudget = oldMaxAge, oldTypes, oldChats, oldBudget
+	}()
+
+	tests := []struct {
+		name    string
+		types   string
+		chats   string
+		want    RetentionPolicy
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			want: RetentionPolicy{MaxAge: time.Hour, TypeMaxAge: map[string]time.Duration{}, ChatMaxAge: map[string]time.Duration{}, DiskBudget: 1024},
+		},
+		{
+			name:  "rules",
+			types: "video=720h, audio = 24h",
+			chats: "905321234567@s.whatsapp.net=8760h,905321234567:12@s.whatsapp.net=1h",
+			want: RetentionPolicy{
+				MaxAge:     time.Hour,
+				TypeMaxAge: map[string]time.Duration{"video": 720 * time.Hour, "audio": 24 * time.Hour},
+				// Device JIDs are normalized, and the last rule for a chat wins.
+				ChatMaxAge: map[string]time.Duration{"905321234567@s.whatsapp.net": time.Hour},
+				DiskBudget: 1024,
+			},
+		},
+		{name: "unknown type", types: "gif=1h", wantErr: true},
+		{name: "missing duration", types: "video", wantErr: true},
+		{name: "invalid duration", types: "video=30d", wantErr: true},
+		{name: "invalid chat", chats: "905321234567:x@s.whatsapp.net=1h", wantErr: true},
+	}
+	for _, tt := range tests {
+		*retentionMaxAge, *retentionTypes, *retentionChats, *retentionDiskBudget = time.Hour, tt.types, tt.chats, 1024
+		got, err := parseRetentionPolicy()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetentionPolicyMaxAge(t *testing.T) {
+	policy := RetentionPolicy{
+		MaxAge:     time.Hour,
+		TypeMaxAge: map[string]time.Duration{"video": 2 * time.Hour},
+		ChatMaxAge: map[string]time.Duration{"chat@s.whatsapp.net": 3 * time.Hour},
+	}
+	tests := []struct {
+		media Media
+		want  time.Duration
+	}{
+		{Media{RemoteJID: "other@s.whatsapp.net", MediaType: "image"}, time.Hour},
+		{Media{RemoteJID: "other@s.whatsapp.net", MediaType: "video"}, 2 * time.Hour},
+		{Media{RemoteJID: "chat@s.whatsapp.net", MediaType: "video"}, 3 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := policy.maxAge(tt.media); got != tt.want {
+			t.Errorf("maxAge(%s, %s) = %s, want %s", tt.media.RemoteJID, tt.media.MediaType, got, tt.want)
+		}
+	}
+	if (RetentionPolicy{TypeMaxAge: map[string]time.Duration{}}).enabled() {
+		t.Error("empty policy is enabled")
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Downloaded media of the types in -scan-types is scanned for malware before it is stored,
+// either by streaming it to clamd at -clamd-address or by running -scan-command with the path
+// of a temporary copy of the file. Rejected files are stored under quarantine/ instead, are
+// never served and their message is flagged. Files that couldn't be scanned, e.g. because clamd
+// is down, aren't stored and their media stays pending until the scan is retried. Files that
+// can never be scanned, because they exceed the size limit of clamd or their scan failed
+// -media-retry-max times, aren't stored either and get the unscanned status. Stored media
+// can be scanned again with the rescan command, which also releases quarantined files that are
+// no longer rejected.
+
+const clamdChunkSize = 64 * 1024
+
+// Check if media of a kind has to be scanned.
+func shouldScan(kind string) bool {
+	if *clamdAddress == "" && *scanCommand == "" {
+		return false
+	}
+	for _, item := range splitList(*scanTypes) {
+		if item == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan a file with clamd using the INSTREAM command. It returns the name of the detected
+// signature, or an empty string if the file is clean.
+func scanWithClamd(data []byte) (string, error) {
+	network, address := "tcp", *clamdAddress
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	} else if strings.HasPrefix(address, "/") {
+		network = "unix"
+	} else {
+		address = strings.TrimPrefix(address, "tcp:")
+	}
+	conn, err := net.DialTimeout(network, address, 10*time.Second)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Minute)); err != nil {
+		return "", err
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", fmt.Errorf("failed to send to clamd: %w", err)
+	}
+	var size [4]byte
+	for start := 0; start < len(data); start += clamdChunkSize {
+		chunk := data[start:]
+		if len(chunk) > clamdChunkSize {
+			chunk = chunk[:clamdChunkSize]
+		}
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+		if _, err := conn.Write(size[:]); err != nil {
+			return "", fmt.Errorf("failed to send to clamd: %w", err)
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			return "", fmt.Errorf("failed to send to clamd: %w", err)
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := conn.Write(size[:]); err != nil {
+		return "", fmt.Errorf("failed to send to clamd: %w", err)
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	// The reply is "stream: OK", "stream: <signature> FOUND" or "<message> ERROR".
+	result := strings.TrimPrefix(strings.TrimSpace(string(bytes.TrimRight(reply, "\x00"))), "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	case strings.Contains(result, "size limit exceeded"):
+		return "", fmt.Errorf("%w: clamd: %s", errScanTooLarge, result)
+	default:
+		return "", fmt.Errorf("clamd: %s", result)
+	}
+}
+
+// Scan a file with -scan-command. Like clamscan, the command must exit with status 0 for clean
+// files and 1 for infected files, in which case its output is returned as the reason.
+func scanWithCommand(data []byte) (string, error) {
+	args := strings.Fields(*scanCommand)
+	if len(args) == 0 {
+		return "", errors.New("no scan command set")
+	}
+	path, cleanup, err := writeTempFile("scan-*", data)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, args[0], append(args[1:], path)...).CombinedOutput()
+	var exitErr *exec.ExitError
+	if err == nil {
+		return "", nil
+	} else if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		reason := strings.TrimSpace(strings.ReplaceAll(string(output), path, "file"))
+		if reason == "" {
+			reason = "rejected by scan command"
+		}
+		return reason, nil
+	}
+	if output = bytes.TrimSpace(output); len(output) > 0 {
+		return "", fmt.Errorf("scan command failed: %w: %s", err, output)
+	}
+	return "", fmt.Errorf("scan command failed: %w", err)
+}
+
+// Returned when a file couldn't be scanned, so that it is scanned again later.
+var errScanFailed = errors.New("scan failed")
+
+// Returned when a file is too large to be scanned, so that scanning it again is pointless.
+var errScanTooLarge = errors.New("file exceeds the scan size limit")
+
+// Scan a file with clamd or -scan-command. It returns the reason the file was rejected, or an
+// empty string if it is clean.
+func scanData(data []byte) (string, error) {
+	if *clamdAddress != "" {
+		return scanWithClamd(data)
+	}
+	return scanWithCommand(data)
+}
+
+// Scan downloaded media if required. If the file is rejected, it is quarantined, the media is
+// updated accordingly and false is returned, as it is for files too large to be scanned, which
+// get the unscanned status. If it can't be scanned for now, an error wrapping errScanFailed is
+// returned and the file must not be stored.
+func scanMedia(media *Media, data []byte) (bool, error) {
+	if !shouldScan(media.MediaType) {
+		return true, nil
+	}
+	reason, err := scanData(data)
+	if errors.Is(err, errScanTooLarge) {
+		log.Errorf("Media of %s can't be scanned: %v", media.MessageID, err)
+		media.Status, media.ScanResult, media.Size = MediaUnscanned, err.Error(), int64(len(data))
+		return false, nil
+	} else if err != nil {
+		log.Errorf("Failed to scan media of %s: %v", media.MessageID, err)
+		return false, fmt.Errorf("%w: %v", errScanFailed, err)
+	} else if reason == "" {
+		log.Debugf("Media of %s is clean", media.MessageID)
+		return true, nil
+	}
+	quarantineMedia(media, data, reason)
+	return false, nil
+}
+
+// Store a rejected file under quarantine/ and update its media accordingly.
+func quarantineMedia(media *Media, data []byte, reason string) {
+	log.Warnf("Quarantining media of %s: %s", media.MessageID, reason)
+	key := "quarantine/" + media.MessageID + extensionForMimeType(media.MimeType)
+	if err := saveMedia(key, data, media.MimeType); err != nil {
+		log.Errorf("Failed to quarantine media of %s: %v", media.MessageID, err)
+		key = ""
+	}
+	media.StorageKey, media.Status, media.ScanResult, media.Size = key, MediaQuarantined, reason, int64(len(data))
+}
+
+// Flag the message of quarantined media and tell clients about it.
+func flagQuarantinedMessage(media *Media) {
+	if err := flagMessage(media.MessageID, media.ScanResult); err != nil {
+		log.Errorf("Error flagging message %s: %v", media.MessageID, err)
+	}
+	notifyMediaStatus(media)
+}
+
+// Scan the stored file of media again. Rejected files are quarantined, and quarantined files
+// that are now clean are stored as a blob again and their message is unflagged.
+func rescanMedia(media *Media) error {
+	if media.StorageKey == "" || (media.Status != MediaAvailable && media.Status != MediaQuarantined) {
+		return fmt.Errorf("media of %s isn't stored", media.MessageID)
+	}
+	data, err := readMedia(media.StorageKey)
+	if err != nil {
+		return fmt.Errorf("failed to read media of %s: %w", media.MessageID, err)
+	}
+	reason, err := scanData(data)
+	if err != nil {
+		return fmt.Errorf("failed to scan media of %s: %w", media.MessageID, err)
+	}
+
+	switch {
+	case reason != "" && media.Status == MediaAvailable && media.SHA256 != "":
+		return quarantineBlob(media, data, reason)
+	case reason != "" && media.Status == MediaAvailable:
+		quarantineMedia(media, data, reason)
+		if err := upsertMedia(*media); err != nil {
+			return err
+		}
+		flagQuarantinedMessage(media)
+	case reason == "" && media.Status == MediaQuarantined:
+		quarantineKey := media.StorageKey
+		blob, err := storeBlob(data, media.MimeType)
+		if err != nil {
+			return err
+		}
+		media.StorageKey, media.SHA256, media.Size, media.Status, media.ScanResult = blob.StorageKey, blob.SHA256, blob.Size, MediaAvailable, ""
+		if err := upsertMedia(*media); err != nil {
+			return err
+		}
+		if err := mediaStore.Delete(context.Background(), quarantineKey); err != nil {
+			log.Errorf("Failed to delete %s: %v", quarantineKey, err)
+		}
+		if err := unflagMessage(media.MessageID); err != nil {
+			log.Errorf("Error unflagging message %s: %v", media.MessageID, err)
+		}
+		log.Infof("Released media of %s from quarantine", media.MessageID)
+		notifyMediaStatus(media)
+	case reason != "" && reason != media.ScanResult:
+		media.ScanResult = reason
+		return upsertMedia(*media)
+	}
+	return nil
+}
+
+// Quarantine a stored blob rejected by a rescan. The media of every message stored in it is
+// quarantined, and the blob is released and deleted once no longer referenced, so that the
+// file isn't served for any message anymore.
+func quarantineBlob(media *Media, data []byte, reason string) error {
+	sha256, blobKey := media.SHA256, media.StorageKey
+	referencing, err := listBlobMedia(sha256)
+	if err != nil {
+		return err
+	}
+	for i := range referencing {
+		m := &referencing[i]
+		if m.MessageID == media.MessageID {
+			m = media
+		}
+		quarantineMedia(m, data, reason)
+		if m.ThumbnailKey == blobThumbnailKey(sha256) {
+			m.ThumbnailKey = ""
+		}
+		deleteKeys, err := quarantineStoredMedia(*m, sha256, blobKey)
+		if err != nil {
+			return err
+		}
+		m.SHA256 = ""
+		for _, key := range deleteKeys {
+			if err := mediaStore.Delete(context.Background(), key); err != nil && !errors.Is(err, ErrMediaNotFound) {
+				log.Errorf("Failed to delete %s: %v", key, err)
+			}
+		}
+		flagQuarantinedMessage(m)
+	}
+	return nil
+}
+
+func handleRescanMedia(args []string) {
+	if len(args) < 1 {
+		log.Errorf("Usage: rescan <message_id>")
+		sendReply("rescan", nil, fmt.Errorf("usage: rescan <message_id>"))
+		return
+	}
+	if *clamdAddress == "" && *scanCommand == "" {
+		sendReply("rescan", nil, fmt.Errorf("malware scanning is not enabled"))
+		return
+	}
+
+	media, err := getMedia(args[0])
+	if err != nil {
+		log.Errorf("Failed to get media: %v", err)
+		sendReply("rescan", nil, err)
+		return
+	}
+	if err := rescanMedia(media); err != nil {
+		log.Errorf("Failed to rescan media: %v", err)
+		sendReply("rescan", media, err)
+		return
+	}
+	sendReply("rescan", media, nil)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Start a fake clamd that answers one INSTREAM command with reply, and return its address and
+// a channel receiving the streamed file.
+func fakeClamd(t *testing.T, reply string) (string, <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		command := make([]byte, len("zINSTREAM\x00"))
+		if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+			return
+		}
+		var data []byte
+		for {
+			var size [4]byte
+			if _, err := io.ReadFull(conn, size[:]); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size[:])
+			if n == 0 {
+				break
+			}
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(conn, chunk); err != nil {
+				return
+			}
+			data = append(data, chunk...)
+		}
+		received <- data
+		conn.Write([]byte(reply + "\x00"))
+	}()
+	return "tcp:" + listener.Addr().String(), received
+}
+
+func TestScanWithClamd(t *testing.T) {
+	defer func(address string) { *clamdAddress = address }(*clamdAddress)
+	data := bytes.Repeat([]byte("0123456789"), 3*clamdChunkSize/10+7)
+
+	tests := []struct {
+		name       string
+		reply      string
+		wantReason string
+		wantErr    bool
+	}{
+		{name: "clean", reply: "stream: OK"},
+		{name: "infected", reply: "stream: Eicar-Test-Signature FOUND", wantReason: "Eicar-Test-Signature"},
+		{name: "clamd error", reply: "INSTREAM size limit exceeded. ERROR", wantErr: true},
+	}
+	for _, tt := range tests {
+		var received <-chan []byte
+		*clamdAddress, received = fakeClamd(t, tt.reply)
+		reason, err := scanWithClamd(data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: scanWithClamd() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if reason != tt.wantReason {
+			t.Errorf("%s: scanWithClamd() = %q, want %q", tt.name, reason, tt.wantReason)
+		}
+		if got := <-received; !bytes.Equal(got, data) {
+			t.Errorf("%s: clamd received %d bytes, want %d", tt.name, len(got), len(data))
+		}
+	}
+}
+
+func TestScanWithCommand(t *testing.T) {
+	defer func(command, dir string) { *scanCommand, *tempDir = command, dir }(*scanCommand, *tempDir)
+	*tempDir = t.TempDir()
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no shell to run scan commands with")
+	}
+
+	tests := []struct {
+		name       string
+		script     string
+		wantReason string
+		wantErr    bool
+	}{
+		{name: "clean", script: "exit 0"},
+		{name: "infected", script: `echo "$1: Eicar-Test-Signature FOUND"; exit 1`, wantReason: "file: Eicar-Test-Signature FOUND"},
+		{name: "infected without output", script: "exit 1", wantReason: "rejected by scan command"},
+		{name: "scanner error", script: "echo 'database not found' >&2; exit 2", wantErr: true},
+	}
+	for _, tt := range tests {
+		script := filepath.Join(t.TempDir(), "scan.sh")
+		if err := os.WriteFile(script, []byte("#!/bin/sh\n"+tt.script+"\n"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		*scanCommand = script
+		reason, err := scanWithCommand([]byte("data"))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: scanWithCommand() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if reason != tt.wantReason {
+			t.Errorf("%s: scanWithCommand() = %q, want %q", tt.name, reason, tt.wantReason)
+		}
+	}
+}
+
+func TestScanMediaFailureKeepsMediaPending(t *testing.T) {
+	defer func(address, types string) { *clamdAddress, *scanTypes = address, types }(*clamdAddress, *scanTypes)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	*clamdAddress, *scanTypes = "tcp:"+listener.Addr().String(), "document"
+	listener.Close()
+
+	media := &Media{MessageID: "ABC", MediaType: "document", MimeType: "application/pdf", Status: MediaPending}
+	clean, err := scanMedia(media, []byte("data"))
+	if clean || !errors.Is(err, errScanFailed) {
+		t.Fatalf("scanMedia() = %v, %v, want false, errScanFailed", clean, err)
+	}
+	if media.Status != MediaPending || media.StorageKey != "" {
+		t.Errorf("media is %s with key %q after a failed scan, want pending without a key", media.Status, media.StorageKey)
+	}
+
+	media.MediaType = "image"
+	if clean, err := scanMedia(media, []byte("data")); !clean || err != nil {
+		t.Errorf("scanMedia() of a type that isn't scanned = %v, %v, want true, nil", clean, err)
+	}
+}
+
+func TestScanMediaTooLargeIsUnscanned(t *testing.T) {
+	defer func(address, types string) { *clamdAddress, *scanTypes = address, types }(*clamdAddress, *scanTypes)
+	*clamdAddress, _ = fakeClamd(t, "INSTREAM size limit exceeded. ERROR")
+	*scanTypes = "document"
+
+	media := &Media{MessageID: "ABC", MediaType: "document", MimeType: "application/pdf", Status: MediaPending}
+	clean, err := scanMedia(media, []byte("data"))
+	if clean || err != nil {
+		t.Fatalf("scanMedia() = %v, %v, want false, nil", clean, err)
+	}
+	if media.Status != MediaUnscanned || media.StorageKey != "" || media.ScanResult == "" {
+		t.Errorf("media is %s with key %q and result %q, want unscanned without a key", media.Status, media.StorageKey, media.ScanResult)
+	}
+}
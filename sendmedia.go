@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// The send_media command sends a file fetched from a URL or the stored media of another
+// message. URLs are only fetched from the hosts in -media-url-allowlist, or their subdomains,
+// and are limited by -media-url-timeout and the upload size limits.
+
+// Check if a URL may be fetched according to -media-url-allowlist.
+func isAllowedMediaURL(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range splitList(*mediaURLAllowlist) {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch a file to send from an allowed URL. It returns the file, its name and its mimetype.
+func fetchMediaURL(rawURL string) ([]byte, string, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("invalid URL: %w", err)
+	}
+	if !isAllowedMediaURL(u) {
+		return nil, "", "", fmt.Errorf("host %s is not in the media URL allowlist", u.Hostname())
+	}
+
+	client := &http.Client{
+		Timeout: *mediaURLTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			} else if !isAllowedMediaURL(req.URL) {
+				return fmt.Errorf("redirect to %s, which is not in the media URL allowlist", req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to fetch %s: %w", u.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", fmt.Errorf("failed to fetch %s: %s", u.Redacted(), resp.Status)
+	}
+
+	reader, mimeType, err := sniffContentType(resp.Body)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read %s: %w", u.Redacted(), err)
+	}
+	kind := uploadKind(mimeType)
+	limit := uploadLimit(kind)
+	if resp.ContentLength > limit {
+		return nil, "", "", &fileTooLargeError{Kind: kind, Limit: limit}
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read %s: %w", u.Redacted(), err)
+	} else if int64(len(data)) > limit {
+		return nil, "", "", &fileTooLargeError{Kind: kind, Limit: limit}
+	}
+
+	fileName := path.Base(resp.Request.URL.Path)
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		fileName = path.Base(params["filename"])
+	}
+	if fileName == "/" || fileName == "." {
+		fileName = "document" + extensionForMimeType(mimeType)
+	}
+	return data, fileName, mimeType, nil
+}
+
+// Read the stored media of a message to send it again, downloading it first if needed.
+// It returns the file, its name and its mimetype.
+func readStoredMedia(messageID string) ([]byte, string, string, error) {
+	media, err := getMedia(messageID)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to get media of %s: %w", messageID, err)
+	}
+	switch media.Status {
+	case MediaLost, MediaPurged:
+		return nil, "", "", fmt.Errorf("media of %s is no longer available", messageID)
+	case MediaQuarantined:
+		return nil, "", "", fmt.Errorf("media of %s is quarantined: %s", messageID, media.ScanResult)
+	case MediaUnscanned:
+		return nil, "", "", fmt.Errorf("media of %s couldn't be scanned: %s", messageID, media.ScanResult)
+	}
+	if media.StorageKey == "" {
+		if wait := mediaRetryWait(media); wait > 0 {
+			return nil, "", "", fmt.Errorf("download of media of %s is being retried, try again in %s", messageID, wait.Round(time.Second))
+		}
+		if err := downloadMedia(media); err != nil {
+			requestMediaRetry(media, err)
+			return nil, "", "", fmt.Errorf("failed to download media of %s: %w", messageID, err)
+		} else if media.Status == MediaQuarantined {
+			return nil, "", "", fmt.Errorf("media of %s is quarantined: %s", messageID, media.ScanResult)
+		} else if media.Status == MediaUnscanned {
+			return nil, "", "", fmt.Errorf("media of %s couldn't be scanned: %s", messageID, media.ScanResult)
+		}
+	}
+
+	data, err := readMedia(media.StorageKey)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read media of %s: %w", messageID, err)
+	}
+	fileName := media.FileName
+	if fileName == "" {
+		fileName = media.MediaType + extensionForMimeType(media.MimeType)
+	}
+	return data, fileName, media.MimeType, nil
+}
+
+func handleSendMedia(args []string, userID int) {
+	if len(args) < 2 {
+		log.Errorf("Usage: send_media <jid> <url|message_id> [caption]")
+		sendReply("send_media", nil, fmt.Errorf("usage: send_media <jid> <url|message_id> [caption]"))
+		return
+	}
+
+	var data []byte
+	var fileName, mimeType string
+	var err error
+	if strings.HasPrefix(args[1], "http://") || strings.HasPrefix(args[1], "https://") {
+		data, fileName, mimeType, err = fetchMediaURL(args[1])
+	} else {
+		data, fileName, mimeType, err = readStoredMedia(args[1])
+	}
+	if err != nil {
+		log.Errorf("Failed to get media to send: %v", err)
+		sendReply("send_media", nil, err)
+		return
+	}
+
+	opts := sendOptions{Caption: strings.Join(args[2:], " ")}
+	messageID, err := sendFile(args[0], fileName, mimeType, userID, data, opts)
+	if err != nil {
+		log.Errorf("Failed to send media: %v", err)
+		sendReply("send_media", nil, err)
+		return
+	}
+	sendReply("send_media", map[string]interface{}{"message_id": messageID}, nil)
+}
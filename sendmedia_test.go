@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIsAllowedMediaURL(t *testing.T) {
+	oldAllowlist := *mediaURLAllowlist
+	defer func() { *mediaURLAllowlist = oldAllowlist }()
+	*mediaURLAllowlist = "example.com, CDN.example.org"
+
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com/a.jpg", true},
+		{"http://example.com:8080/a.jpg", true},
+		{"https://img.example.com/a.jpg", true},
+		{"https://EXAMPLE.com/a.jpg", true},
+		{"https://cdn.example.org/a.jpg", true},
+		{"https://example.org/a.jpg", false},
+		{"https://badexample.com/a.jpg", false},
+		{"https://example.com.evil.net/a.jpg", false},
+		{"https://evil.net/?u=https://example.com", false},
+		{"ftp://example.com/a.jpg", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isAllowedMediaURL(u); got != tt.want {
+			t.Errorf("isAllowedMediaURL(%s) = %t, want %t", tt.url, got, tt.want)
+		}
+	}
+
+	*mediaURLAllowlist = ""
+	if u, _ := url.Parse("https://example.com/a.jpg"); isAllowedMediaURL(u) {
+		t.Error("URL is allowed without an allowlist")
+	}
+}
+
+func TestFetchMediaURL(t *testing.T) {
+	oldAllowlist, oldLimit := *mediaURLAllowlist, *maxDocumentSize
+	defer func() { *mediaURLAllowlist, *maxDocumentSize = oldAllowlist, oldLimit }()
+	*mediaURLAllowlist = "127.0.0.1"
+	*maxDocumentSize = 16
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/report":
+			w.Header().Set("Content-Disposition", `attachment; filename="../report.txt"`)
+			w.Write([]byte("quarterly report"))
+		case "/large.txt":
+			w.Write([]byte(strings.Repeat("a", 17)))
+		case "/redirect":
+			// localhost isn't in the allowlist, even though it's the same server.
+			http.Redirect(w, r, strings.Replace(r.Host, "127.0.0.1", "http://localhost", 1)+"/report", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	data, fileName, mimeType, err := fetchMediaURL(server.URL + "/report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "quarterly report" || fileName != "report.txt" || !strings.HasPrefix(mimeType, "text/plain") {
+		t.Errorf("fetchMediaURL() = %q, %q, %q", data, fileName, mimeType)
+	}
+
+	var tooLargeErr *fileTooLargeError
+	if _, _, _, err := fetchMediaURL(server.URL + "/large.txt"); !errors.As(err, &tooLargeErr) {
+		t.Errorf("fetching a large file: error = %v, want fileTooLargeError", err)
+	}
+	if _, _, _, err := fetchMediaURL(server.URL + "/redirect"); err == nil || !strings.Contains(err.Error(), "allowlist") {
+		t.Errorf("following a redirect to another host: error = %v, want allowlist error", err)
+	}
+	if _, _, _, err := fetchMediaURL(server.URL + "/missing"); err == nil {
+		t.Error("fetching a missing file succeeded")
+	}
+	if _, _, _, err := fetchMediaURL("http://localhost/report"); err == nil || !strings.Contains(err.Error(), "allowlist") {
+		t.Errorf("fetching from another host: error = %v, want allowlist error", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Uploads and the files passed to ffmpeg, poppler and the scan command are written to
+// -temp-dir, which is only accessible to the user running the service, as they hold media in
+// plaintext even when it is encrypted at rest. Files in it are created with 0600 permissions.
+
+// Get the private temporary directory, creating it or restricting its permissions if needed.
+func privateTempDir() (string, error) {
+	dir := *tempDir
+	if dir == "" {
+		dir = filepath.Join(*dirPtr, ".tmp")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// Write data to a file in the private temporary directory, returning its path and a function
+// that removes it.
+func writeTempFile(pattern string, data []byte) (string, func(), error) {
+	dir, err := privateTempDir()
+	if err != nil {
+		return "", nil, err
+	}
+	tmp, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		cleanup()
+		return "", nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return tmp.Name(), cleanup, nil
+}
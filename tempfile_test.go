@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteTempFile(t *testing.T) {
+	defer func(dir string) { *tempDir = dir }(*tempDir)
+	*tempDir = filepath.Join(t.TempDir(), "tmp")
+	// An existing directory that others can read is restricted.
+	if err := os.Mkdir(*tempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path, cleanup, err := writeTempFile("test-*", []byte("data"))
+	if err != nil {
+		t.Fatalf("writeTempFile() error = %v", err)
+	}
+	if filepath.Dir(path) != *tempDir {
+		t.Errorf("writeTempFile() wrote %s, want a file in %s", path, *tempDir)
+	}
+	for name, want := range map[string]os.FileMode{*tempDir: 0700, path: 0600} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != want {
+			t.Errorf("%s has permissions %o, want %o", name, perm, want)
+		}
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Errorf("temporary file contains %q, %v, want %q", data, err, "data")
+	}
+	cleanup()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("temporary file still exists after cleanup: %v", err)
+	}
+}
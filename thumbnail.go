@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp" // Stickers are WebP images
+)
+
+// Images with more pixels than this aren't decoded, since a small file can decode into a huge
+// bitmap.
+const maxImagePixels = 50_000_000
+
+// Check the dimensions in the header of an image before it is decoded.
+func checkImageSize(data []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	} else if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return fmt.Errorf("image of %dx%d pixels is too large", config.Width, config.Height)
+	}
+	return nil
+}
+
+// Create a small JPEG thumbnail of an image, sized and compressed according to
+// -thumbnail-size and -thumbnail-quality.
+func makeThumbnail(data []byte) ([]byte, error) {
+	if err := checkImageSize(data); err != nil {
+		return nil, err
+	}
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	thumbnail := imaging.Thumbnail(img, *thumbnailSize, *thumbnailSize, imaging.Lanczos)
+
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, thumbnail, imaging.JPEG, imaging.JPEGQuality(*thumbnailQuality)); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Extract a frame from a video with ffmpeg. The frame is taken a second in, unless the
+// video is shorter than that. Videos come from untrusted senders, so ffmpeg runs with a single
+// thread, limited to -ffmpeg-memory-limit and to 30 seconds of CPU time and wall time.
+func extractVideoFrame(data []byte) ([]byte, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, err
+	}
+
+	// ffmpeg needs to seek in most video containers, so the video is passed as a file.
+	path, cleanup, err := writeTempFile("video-*", data)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	// The limits are set by the shell that then runs ffmpeg in its place.
+	memoryLimit := "unlimited"
+	if *ffmpegMemoryLimit > 0 {
+		memoryLimit = strconv.FormatInt(*ffmpegMemoryLimit>>10, 10)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", `ulimit -v "$1" && ulimit -t 30 && shift && exec "$@"`, "sh", memoryLimit,
+		ffmpeg, "-v", "error", "-threads", "1", "-i", path, "-threads", "1", "-vf", "thumbnail", "-frames:v", "1", "-f", "image2pipe", "-c:v", "mjpeg", "-")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg produced no frame")
+	}
+	return stdout.Bytes(), nil
+}
+
+// Create the thumbnail of a media file. Images and stickers are thumbnailed from the file
+// itself and videos from a frame extracted with ffmpeg, if it is installed. Otherwise, or if
+// that fails, the thumbnail embedded in the message is used. Either of data and embedded
+// may be empty, in which case there may be no thumbnail.
+func createThumbnail(kind string, data, embedded []byte) ([]byte, error) {
+	var source []byte
+	var err error
+	if len(data) > 0 {
+		switch kind {
+		case "image", "sticker":
+			source = data
+		case "video":
+			if source, err = extractVideoFrame(data); err != nil {
+				log.Debugf("Falling back to embedded video thumbnail: %v", err)
+			}
+		}
+	}
+	if len(source) > 0 {
+		thumbnail, err := makeThumbnail(source)
+		if err == nil {
+			return thumbnail, nil
+		}
+		log.Debugf("Falling back to embedded thumbnail: %v", err)
+	}
+	if len(embedded) == 0 {
+		return nil, nil
+	}
+	return makeThumbnail(embedded)
+}
+
+// Create and store the thumbnail of the media of a message, setting its thumbnail key.
+// Thumbnails made from a stored file are stored with its blob, so every message with the same
+// file shares one thumbnail, which is only made once. Thumbnails embedded in messages are
+// stored per message.
+func storeThumbnail(media *Media, data, embedded []byte) {
+	if media.SHA256 != "" && len(data) > 0 {
+		key := blobThumbnailKey(media.SHA256)
+		if _, err := mediaStore.Stat(context.Background(), key); err == nil {
+			media.ThumbnailKey = key
+			return
+		}
+		thumbnail, err := createThumbnail(media.MediaType, data, nil)
+		if err != nil {
+			log.Errorf("Error creating thumbnail of %s: %v", media.MessageID, err)
+		} else if thumbnail != nil {
+			if err := saveMedia(key, thumbnail, "image/jpeg"); err != nil {
+				log.Errorf("Error saving thumbnail of %s: %v", media.MessageID, err)
+				return
+			}
+			media.ThumbnailKey = key
+			return
+		}
+		data = nil
+	}
+
+	thumbnail, err := createThumbnail(media.MediaType, data, embedded)
+	if err != nil {
+		log.Errorf("Error creating thumbnail of %s: %v", media.MessageID, err)
+		return
+	} else if thumbnail == nil {
+		return
+	}
+	if err := saveMedia(thumbnailKey(media.MessageID), thumbnail, "image/jpeg"); err != nil {
+		log.Errorf("Error saving thumbnail of %s: %v", media.MessageID, err)
+		return
+	}
+	media.ThumbnailKey = thumbnailKey(media.MessageID)
+}
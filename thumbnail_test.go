@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStoreThumbnailReusesBlobThumbnail(t *testing.T) {
+	store, err := newLocalMediaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStore := mediaStore
+	defer func() { mediaStore = oldStore }()
+	mediaStore = store
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 200, 100))); err != nil {
+		t.Fatal(err)
+	}
+
+	first := Media{MessageID: "first", SHA256: "abc", MediaType: "image"}
+	storeThumbnail(&first, buf.Bytes(), nil)
+	if first.ThumbnailKey != blobThumbnailKey("abc") {
+		t.Fatalf("thumbnail key = %q, want %q", first.ThumbnailKey, blobThumbnailKey("abc"))
+	}
+
+	// The thumbnail of the blob is reused without decoding the file again.
+	second := Media{MessageID: "second", SHA256: "abc", MediaType: "image"}
+	storeThumbnail(&second, []byte("not an image"), nil)
+	if second.ThumbnailKey != first.ThumbnailKey {
+		t.Errorf("thumbnail key = %q, want %q", second.ThumbnailKey, first.ThumbnailKey)
+	}
+
+	// Without a stored file, the embedded thumbnail is stored with the message.
+	embedded := Media{MessageID: "embedded", MediaType: "video"}
+	storeThumbnail(&embedded, nil, buf.Bytes())
+	if embedded.ThumbnailKey != thumbnailKey("embedded") {
+		t.Errorf("thumbnail key = %q, want %q", embedded.ThumbnailKey, thumbnailKey("embedded"))
+	}
+	if _, err := store.Stat(context.Background(), embedded.ThumbnailKey); err != nil {
+		t.Errorf("embedded thumbnail wasn't stored: %v", err)
+	}
+}
+
+func TestExtractVideoFrameLimitsFFmpeg(t *testing.T) {
+	oldTempDir, oldLimit := *tempDir, *ffmpegMemoryLimit
+	defer func() { *tempDir, *ffmpegMemoryLimit = oldTempDir, oldLimit }()
+	*tempDir = t.TempDir()
+	*ffmpegMemoryLimit = 256 << 20
+
+	// The fake ffmpeg prints its limits and arguments instead of a frame.
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho \"$(ulimit -v) $(ulimit -t) $*\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	output, err := extractVideoFrame([]byte("video"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(output), "262144 30 ") {
+		t.Errorf("ffmpeg ran with limits %q, want 262144 KiB and 30 s", output)
+	}
+	if !strings.Contains(string(output), "-threads 1 -i ") {
+		t.Errorf("ffmpeg ran with arguments %q, want a single decoding thread", output)
+	}
+}
+
+func TestMakeThumbnailRejectsHugeImages(t *testing.T) {
+	// A PNG header claiming 100000x100000 pixels, without any image data.
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], 100000)
+	binary.BigEndian.PutUint32(ihdr[8:], 100000)
+	ihdr[12], ihdr[13] = 8, 2 // 8 bit RGB
+	header := []byte("\x89PNG\r\n\x1a\n")
+	header = binary.BigEndian.AppendUint32(header, 13)
+	header = append(header, ihdr...)
+	header = binary.BigEndian.AppendUint32(header, crc32.ChecksumIEEE(ihdr))
+
+	if _, err := makeThumbnail(header); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("makeThumbnail() error = %v, want the image rejected as too large", err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+)
+
+const (
+	maxUploadFieldSize    = 1 << 20 // Maximum size of non-file form fields
+	uploadProgressMinSize = 1 << 20 // Progress is only reported for requests larger than this
+	maxUploadFiles        = 30      // Maximum number of files per upload, the size of a WhatsApp album
+)
+
+// An uploaded file spooled to a temporary file.
+type uploadedFile struct {
+	Name     string
+	MimeType string
+	Kind     string
+	Path     string
+	Size     int64
+}
+
+func (f *uploadedFile) remove() {
+	if err := os.Remove(f.Path); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to remove temporary upload %s: %v", f.Path, err)
+	}
+}
+
+// Check if a file of a mimetype can be sent as a video message.
+func isSendableVideo(mimeType string) bool {
+	return mimeType == "video/mp4"
+}
+
+// Check if a file of a mimetype can be sent as an audio message.
+func isSendableAudio(mimeType string) bool {
+	switch mimeType {
+	case "audio/mpeg", "audio/mp4", "audio/aac", "audio/amr", "audio/ogg":
+		return true
+	}
+	return false
+}
+
+// Get the kind of message an uploaded file of a mimetype is sent as, which is also the kind
+// whose size limit applies to it. Files that WhatsApp can't play are sent as documents.
+func uploadKind(mimeType string) string {
+	switch {
+	case isSendableImage(mimeType):
+		return "image"
+	case isSendableVideo(mimeType):
+		return "video"
+	case isSendableAudio(mimeType):
+		return "audio"
+	default:
+		return "document"
+	}
+}
+
+// Send a file as the kind of message it is uploaded as and return the ID of its message.
+func sendFile(JID, fileName, mimeType string, userID int, data []byte, opts sendOptions) (string, error) {
+	switch uploadKind(mimeType) {
+	case "image":
+		return handleSendImage(JID, userID, data, opts)
+	case "video":
+		return handleSendVideo(JID, userID, data, mimeType, opts)
+	case "audio":
+		return handleSendAudio(JID, userID, data, mimeType, opts)
+	default:
+		return handleSendDocument(JID, fileName, userID, data, opts)
+	}
+}
+
+// Get the upload size limit of a kind of media, set with the -max-*-size flags.
+func uploadLimit(kind string) int64 {
+	switch kind {
+	case "image":
+		return *maxImageSize
+	case "video":
+		return *maxVideoSize
+	case "audio":
+		return *maxAudioSize
+	default:
+		return *maxDocumentSize
+	}
+}
+
+type fileTooLargeError struct {
+	Kind  string
+	Limit int64
+}
+
+func (e *fileTooLargeError) Error() string {
+	return fmt.Sprintf("File exceeds the %s limit for %s uploads", formatSize(e.Limit), e.Kind)
+}
+
+func formatSize(size int64) string {
+	if size >= 1<<20 {
+		return fmt.Sprintf("%.0f MB", float64(size)/(1<<20))
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
+
+// Read a spooled file to send it. whatsmeow's Upload only takes a whole file as a []byte, so
+// files are read into memory one at a time, right before they are sent. The size of the file
+// is checked against its limit again first, so that no file larger than it is ever read.
+func (f *uploadedFile) read() ([]byte, error) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	if limit := uploadLimit(f.Kind); info.Size() > limit {
+		return nil, &fileTooLargeError{Kind: f.Kind, Limit: limit}
+	}
+	return os.ReadFile(f.Path)
+}
+
+// ProgressWriter reports how much of an upload request was received over the WebSocket,
+// every 10% of the request size, along with the name of the file being received.
+type progressWriter struct {
+	name     string
+	total    int64
+	received int64
+	reported int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.received += int64(len(b))
+	if p.total >= uploadProgressMinSize && p.received-p.reported >= p.total/10 {
+		p.reported = p.received
+		p.report()
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) report() {
+	percent := int64(100)
+	if p.total > 0 && p.received < p.total {
+		percent = p.received * 100 / p.total
+	}
+	sendReply("uploadprogress", map[string]interface{}{"file": p.name, "received": p.received, "total": p.total, "percent": percent}, nil)
+}
+
+// Detect the mimetype of a file from its first 512 bytes, returning a reader that still reads
+// the whole file.
+func sniffContentType(r io.Reader) (*bufio.Reader, string, error) {
+	reader := bufio.NewReaderSize(r, 512)
+	head, err := reader.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	return reader, http.DetectContentType(head), nil
+}
+
+// Stream a file part to a temporary file in dir, enforcing the size limit of its media type.
+func spoolUpload(part *multipart.Part, dir string, progress *progressWriter) (*uploadedFile, error) {
+	reader, mimeType, err := sniffContentType(part)
+	if err != nil {
+		return nil, err
+	}
+	file := &uploadedFile{Name: part.FileName(), MimeType: mimeType}
+	file.Kind = uploadKind(file.MimeType)
+	limit := uploadLimit(file.Kind)
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	file.Path = tmp.Name()
+	progress.name = file.Name
+	file.Size, err = io.Copy(io.MultiWriter(tmp, progress), io.LimitReader(reader, limit+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && file.Size > limit {
+		err = &fileTooLargeError{Kind: file.Kind, Limit: limit}
+	}
+	if err != nil {
+		file.remove()
+		return nil, err
+	}
+	if progress.total >= uploadProgressMinSize && progress.reported < progress.received {
+		progress.report()
+	}
+	return file, nil
+}
+
+// Read a non-file form field, up to maxUploadFieldSize bytes.
+func readFormField(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(value) > maxUploadFieldSize {
+		return "", fmt.Errorf("form field %s is too large", part.FormName())
+	}
+	return string(value), nil
+}
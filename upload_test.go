@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadKind(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		want     string
+	}{
+		{"image/jpeg", "image"},
+		{"image/png", "image"},
+		{"video/mp4", "video"},
+		{"video/x-matroska", "document"},
+		{"audio/mpeg", "audio"},
+		{"audio/ogg", "audio"},
+		{"audio/flac", "document"},
+		{"application/pdf", "document"},
+		{"", "document"},
+	}
+	for _, tt := range tests {
+		if got := uploadKind(tt.mimeType); got != tt.want {
+			t.Errorf("uploadKind(%q) = %q, want %q", tt.mimeType, got, tt.want)
+		}
+	}
+}
+
+func TestUploadedFileRead(t *testing.T) {
+	oldLimit := *maxVideoSize
+	defer func() { *maxVideoSize = oldLimit }()
+	*maxVideoSize = 4
+
+	path := filepath.Join(t.TempDir(), "upload")
+	file := &uploadedFile{Name: "video.mp4", MimeType: "video/mp4", Kind: "video", Path: path}
+
+	if err := os.WriteFile(path, []byte("1234"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := file.read(); err != nil || string(data) != "1234" {
+		t.Errorf("read() = %q, %v, want %q", data, err, "1234")
+	}
+
+	// The file grew past its limit after it was spooled.
+	if err := os.WriteFile(path, []byte("12345"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var tooLargeErr *fileTooLargeError
+	if _, err := file.read(); !errors.As(err, &tooLargeErr) {
+		t.Errorf("read() error = %v, want fileTooLargeError", err)
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
@@ -73,60 +77,166 @@ func serveQR(w http.ResponseWriter, r *http.Request) {
 	qrterminal.GenerateHalfBlock(qrStr, qrterminal.L, w)
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request, uploadDir string) {
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	err := r.ParseMultipartForm(10 << 20)
+	// The form is streamed part by part, so that files are spooled to disk as they arrive and
+	// rejected as soon as they exceed the limit of their media type.
+	r.Body = http.MaxBytesReader(w, r.Body, *maxUploadSize)
+	reader, err := r.MultipartReader()
 	if err != nil {
 		handleError(w, http.StatusBadRequest, "Failed to parse multipart form", err)
 		return
 	}
 
-	file, handler, err := r.FormFile("file")
+	uploadDir, err := privateTempDir()
 	if err != nil {
-		handleError(w, http.StatusBadRequest, "Failed to retrieve file from request", err)
+		handleError(w, http.StatusInternalServerError, "Failed to create temporary directory", err)
 		return
 	}
-	defer file.Close()
+	fields := map[string]string{}
+	var files []*uploadedFile
+	defer func() {
+		for _, file := range files {
+			file.remove()
+		}
+	}()
+	progress := &progressWriter{total: r.ContentLength}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			handleError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request exceeds the %s upload limit", formatSize(*maxUploadSize)), err)
+			return
+		} else if err != nil {
+			handleError(w, http.StatusBadRequest, "Failed to parse multipart form", err)
+			return
+		}
 
-	JID := r.FormValue("jid")
-	userID, err := strconv.Atoi(r.FormValue("user_id"))
+		if part.FileName() == "" {
+			if fields[part.FormName()], err = readFormField(part); err != nil {
+				handleError(w, http.StatusBadRequest, "Failed to read form field", err)
+				return
+			}
+			continue
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+		if len(files) == maxUploadFiles {
+			handleError(w, http.StatusBadRequest, fmt.Sprintf("At most %d files can be uploaded at once", maxUploadFiles), errors.New("too many files"))
+			return
+		}
+		file, err := spoolUpload(part, uploadDir, progress)
+		var tooLargeErr *fileTooLargeError
+		if errors.As(err, &tooLargeErr) {
+			handleError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%s: %s", part.FileName(), tooLargeErr.Error()), err)
+			return
+		} else if errors.As(err, &maxBytesErr) {
+			handleError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request exceeds the %s upload limit", formatSize(*maxUploadSize)), err)
+			return
+		} else if err != nil {
+			handleError(w, http.StatusInternalServerError, "Failed to store uploaded file", err)
+			return
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		handleError(w, http.StatusBadRequest, "Failed to retrieve file from request", errors.New("no file in request"))
+		return
+	}
+
+	JID := fields["jid"]
+	recipient, err := parseJID(JID)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, "Invalid JID", err)
+		return
+	}
+	userID, err := strconv.Atoi(fields["user_id"])
 	if err != nil {
 		handleError(w, http.StatusBadRequest, "Invalid user ID", err)
 		return
 	}
-
-	data, err := io.ReadAll(file)
+	mentions, err := parseJIDs(splitList(fields["mentions"]))
 	if err != nil {
-		handleError(w, http.StatusInternalServerError, "Failed to read file data", err)
+		handleError(w, http.StatusBadRequest, "Invalid mentions", err)
+		return
+	}
+
+	// The quoted message is only quoted by the first message, while every message mentions.
+	replyInfo, err := createContextInfo(recipient, fields["reply_to"], mentions)
+	if errors.Is(err, sql.ErrNoRows) {
+		handleError(w, http.StatusBadRequest, "Unknown quoted message", err)
+		return
+	} else if err != nil {
+		handleError(w, http.StatusInternalServerError, "Failed to get quoted message", err)
 		return
 	}
+	mentionInfo, _ := createContextInfo(recipient, "", mentions)
+
+	// Files are sent in the order they were uploaded. The caption field is the caption of the
+	// first file, and caption_<n> the caption of the nth file. If a file fails, the files after
+	// it aren't sent, and the response marks them all as failed.
+	results := make([]uploadResult, len(files))
+	status := http.StatusOK
+	for i, file := range files {
+		results[i].File = file.Name
+		if status != http.StatusOK {
+			results[i].Error = "not sent because an earlier file failed"
+			continue
+		}
 
-	mimeType := http.DetectContentType(data)
+		opts := sendOptions{Caption: fields[fmt.Sprintf("caption_%d", i+1)], ContextInfo: mentionInfo}
+		if i == 0 {
+			opts.ContextInfo = replyInfo
+			if opts.Caption == "" {
+				opts.Caption = fields["caption"]
+			}
+		}
 
-	if mimeType == "image/jpeg" {
-		err = handleSendImage(JID, userID, data)
-		if err != nil {
-			handleError(w, http.StatusInternalServerError, "Failed to handle image upload", err)
-			return
+		data, err := file.read()
+		var tooLargeErr *fileTooLargeError
+		if errors.As(err, &tooLargeErr) {
+			status = http.StatusRequestEntityTooLarge
+		} else if err != nil {
+			status = http.StatusInternalServerError
+			err = fmt.Errorf("failed to read file data: %w", err)
+		} else {
+			results[i].MessageID, err = sendFile(JID, file.Name, file.MimeType, userID, data, opts)
+			if err != nil {
+				status = http.StatusInternalServerError
+			}
 		}
-	} else {
-		err = handleSendDocument(JID, handler.Filename, userID, data)
 		if err != nil {
-			handleError(w, http.StatusInternalServerError, "Failed to handle document upload", err)
-			return
+			log.Errorf("Failed to send %s, %d of %d files were sent: %v", file.Name, i, len(files), err)
+			results[i].Error = err.Error()
+			continue
 		}
+		log.Infof("Uploaded file %s to %s, mimetype: %s, size: %d", file.Name, JID, file.MimeType, file.Size)
 	}
 
-	log.Infof("Uploaded file %s to %s, mimetype: %s", handler.Filename, JID, mimeType)
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+// Result of sending an uploaded file. Error is set if the file wasn't sent.
+type uploadResult struct {
+	File      string `json:"file"`
+	MessageID string `json:"message_id,omitempty"`
+	Error     string `json:"error,omitempty"`
 }
 
 func handleError(w http.ResponseWriter, statusCode int, message string, err error) {